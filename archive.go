@@ -0,0 +1,353 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/patapancakes/exdepot/gozelle"
+	"github.com/schollz/progressbar/v3"
+)
+
+// fixed so the same depot version always produces the same archive
+var archiveTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func doTar(data io.ReaderAt, outpath string, keys gozelle.Keys, manifest gozelle.Manifest, index gozelle.Index) error {
+	key, ok := keys[int(manifest.DepotID)]
+	if !ok {
+		log.Print("couldn't find key for depot")
+	}
+
+	w, err := createOutput(outpath)
+	if err != nil {
+		return err
+	}
+
+	return closeOutput(w, writeTar(w, data, key, manifest, index))
+}
+
+func writeTar(w io.Writer, data io.ReaderAt, key []byte, manifest gozelle.Manifest, index gozelle.Index) error {
+	bw := bufio.NewWriterSize(w, 0x10000)
+
+	tw := tar.NewWriter(bw)
+
+	for _, i := range sortedItems(manifest) {
+		hdr := &tar.Header{
+			Name:    i.Path,
+			ModTime: archiveTime,
+			Mode:    0644,
+		}
+
+		if i.IsDirectory() {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			hdr.Mode = 0755
+		} else {
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(i.Size)
+		}
+
+		err := tw.WriteHeader(hdr)
+		if err != nil {
+			return fmt.Errorf("failed to write header for %s: %s", i.Path, err)
+		}
+
+		if i.IsDirectory() {
+			continue
+		}
+
+		file, ok := index[int(i.ID)]
+		if !ok {
+			return fmt.Errorf("file %s missing from index", i.Path)
+		}
+
+		r := file.NewReader(key, data, gozelle.DefaultBufferSize)
+
+		_, err = io.Copy(tw, r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %s", i.Path, err)
+		}
+	}
+
+	err := tw.Close()
+	if err != nil {
+		return fmt.Errorf("failed to finish archive: %s", err)
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write to output file: %s", err)
+	}
+
+	return nil
+}
+
+// every item except the root, ordered by path
+func sortedItems(manifest gozelle.Manifest) []gozelle.Item {
+	var items []gozelle.Item
+	for _, i := range manifest.Items {
+		if i.Path == "" {
+			continue
+		}
+
+		items = append(items, i)
+	}
+
+	slices.SortStableFunc(items, func(a gozelle.Item, b gozelle.Item) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	return items
+}
+
+// files bigger than this are streamed by the writer instead of being compressed ahead of time by a worker
+const zipBufferLimit = 0x1000000
+
+type ZipJob struct {
+	Item gozelle.Item
+	File *gozelle.File
+}
+
+type ZipResult struct {
+	Header *zip.FileHeader
+	Data   []byte
+	Stream bool
+	Err    error
+}
+
+func doZip(data io.ReaderAt, outpath string, workers int, method string, keys gozelle.Keys, manifest gozelle.Manifest, index gozelle.Index) error {
+	var zipMethod uint16
+	switch method {
+	case "store":
+		zipMethod = zip.Store
+	case "deflate":
+		zipMethod = zip.Deflate
+	default:
+		return fmt.Errorf("unknown zip method %s", method)
+	}
+
+	fmt.Printf("Using %d compression workers\n", workers)
+
+	if outpath == "" {
+		outpath = fmt.Sprintf("%d_%d.zip", manifest.DepotID, manifest.DepotVersion)
+	}
+
+	key, ok := keys[int(manifest.DepotID)]
+	if !ok {
+		log.Print("couldn't find key for depot")
+	}
+
+	out, err := createOutput(outpath)
+	if err != nil {
+		return err
+	}
+
+	return closeOutput(out, writeZip(out, data, workers, zipMethod, key, manifest, index))
+}
+
+func writeZip(w io.Writer, data io.ReaderAt, workers int, method uint16, key []byte, manifest gozelle.Manifest, index gozelle.Index) error {
+	bw := bufio.NewWriterSize(w, 0x10000)
+
+	zw := zip.NewWriter(bw)
+
+	var jobs []ZipJob
+	for _, i := range sortedItems(manifest) {
+		jobs = append(jobs, ZipJob{Item: i, File: index[int(i.ID)]})
+	}
+
+	bar := progressbar.Default(int64(len(jobs)), "Compressing")
+
+	err := runOrdered(workers, slices.Values(jobs), func(job ZipJob) ZipResult {
+		return compressZipEntry(job, data, key, method)
+	}, func(job ZipJob, result ZipResult) error {
+		return writeZipEntry(zw, job, result, data, key)
+	}, func(ZipJob) {
+		bar.Add(1)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("failed to finish archive: %s", err)
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write to output file: %s", err)
+	}
+
+	return nil
+}
+
+func writeZipEntry(zw *zip.Writer, job ZipJob, result ZipResult, data io.ReaderAt, key []byte) error {
+	if result.Err != nil {
+		return fmt.Errorf("failed to compress %s: %s", job.Item.Path, result.Err)
+	}
+
+	// already compressed by a worker
+	if !result.Stream {
+		w, err := zw.CreateRaw(result.Header)
+		if err != nil {
+			return fmt.Errorf("failed to write header for %s: %s", job.Item.Path, err)
+		}
+
+		_, err = w.Write(result.Data)
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %s", job.Item.Path, err)
+		}
+
+		return nil
+	}
+
+	w, err := zw.CreateHeader(result.Header)
+	if err != nil {
+		return fmt.Errorf("failed to write header for %s: %s", job.Item.Path, err)
+	}
+
+	r := job.File.NewReader(key, data, gozelle.DefaultBufferSize)
+	defer r.Close()
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %s", job.Item.Path, err)
+	}
+
+	if n != int64(job.Item.Size) {
+		return fmt.Errorf("size mismatch for %s, expected %d bytes, got %d", job.Item.Path, job.Item.Size, n)
+	}
+
+	return nil
+}
+
+func compressZipEntry(job ZipJob, data io.ReaderAt, key []byte, method uint16) ZipResult {
+	if job.Item.IsDirectory() {
+		return ZipResult{Header: zipHeader(job.Item, zip.Store)}
+	}
+
+	hdr := zipHeader(job.Item, method)
+
+	if job.File == nil {
+		return ZipResult{Err: fmt.Errorf("file missing from index")}
+	}
+
+	// left for the writer to stream
+	if job.Item.Size > zipBufferLimit {
+		return ZipResult{Header: hdr, Stream: true}
+	}
+
+	r := job.File.NewReader(key, data, gozelle.DefaultBufferSize)
+	defer r.Close()
+
+	var buf bytes.Buffer
+
+	crc := crc32.NewIEEE()
+
+	var w io.Writer = &buf
+	var fw *flate.Writer
+	if method == zip.Deflate {
+		var err error
+		fw, err = flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return ZipResult{Err: err}
+		}
+
+		w = fw
+	}
+
+	n, err := io.Copy(io.MultiWriter(w, crc), r)
+	if err != nil {
+		return ZipResult{Err: err}
+	}
+
+	if fw != nil {
+		err = fw.Close()
+		if err != nil {
+			return ZipResult{Err: err}
+		}
+	}
+
+	if n != int64(job.Item.Size) {
+		return ZipResult{Err: fmt.Errorf("size mismatch, expected %d bytes, got %d", job.Item.Size, n)}
+	}
+
+	hdr.CRC32 = crc.Sum32()
+	hdr.UncompressedSize64 = uint64(n)
+	hdr.CompressedSize64 = uint64(buf.Len())
+
+	return ZipResult{Header: hdr, Data: buf.Bytes()}
+}
+
+func zipHeader(i gozelle.Item, method uint16) *zip.FileHeader {
+	hdr := &zip.FileHeader{
+		Name:     i.Path,
+		Method:   method,
+		Modified: archiveTime,
+
+		// CreateRaw doesn't fill these in from Modified
+		ModifiedDate: uint16((archiveTime.Year()-1980)<<9 | int(archiveTime.Month())<<5 | archiveTime.Day()),
+		ModifiedTime: uint16(archiveTime.Hour()<<11 | archiveTime.Minute()<<5 | archiveTime.Second()>>1),
+	}
+
+	if i.IsDirectory() {
+		hdr.Name += "/"
+		hdr.Method = zip.Store
+		hdr.SetMode(fs.ModeDir | 0755)
+	} else {
+		hdr.SetMode(0644)
+	}
+
+	return hdr
+}
+
+func doGCF(data io.ReaderAt, outpath string, keepEncryption bool, keys gozelle.Keys, manifest gozelle.Manifest, index gozelle.Index) error {
+	if outpath == "" {
+		outpath = fmt.Sprintf("%d_%d.gcf", manifest.DepotID, manifest.DepotVersion)
+	}
+
+	key, ok := keys[int(manifest.DepotID)]
+	if !ok {
+		log.Print("couldn't find key for depot")
+	}
+
+	out, err := createOutput(outpath)
+	if err != nil {
+		return err
+	}
+
+	err = gozelle.WriteGCF(out, manifest, index, data, key, keepEncryption)
+	if err != nil {
+		err = fmt.Errorf("failed to write gcf: %s", err)
+	}
+
+	return closeOutput(out, err)
+}
@@ -0,0 +1,339 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/patapancakes/exdepot/gozelle"
+	"github.com/schollz/progressbar/v3"
+)
+
+type BatchJob struct {
+	DepotVersion
+
+	// overrides the output path template
+	Outpath string `json:"outpath,omitempty"`
+}
+
+// extracts every depot version in manifestdir, or the ones in a json job list
+func doBatch(jobsfile string, template string, workers int, memory int, dedup string, keyfile string, manifestdir string, storagedir string, manifestchecksum string) error {
+	err := checkDedup(dedup)
+	if err != nil {
+		return err
+	}
+
+	keys, err := gozelle.KeysFromFile(keyfile)
+	if err != nil {
+		return err
+	}
+
+	var jobs []BatchJob
+	if jobsfile != "" {
+		file, err := os.Open(jobsfile)
+		if err != nil {
+			return fmt.Errorf("failed to open job list: %s", err)
+		}
+
+		err = json.NewDecoder(file).Decode(&jobs)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode job list: %s", err)
+		}
+	} else {
+		versions, err := findVersions(manifestdir)
+		if err != nil {
+			return err
+		}
+
+		for _, v := range versions {
+			jobs = append(jobs, BatchJob{DepotVersion: v})
+		}
+	}
+
+	// grouped by depot so each storage is only loaded once
+	slices.SortStableFunc(jobs, func(a BatchJob, b BatchJob) int {
+		return a.Depot - b.Depot
+	})
+
+	for n, j := range jobs {
+		if j.Outpath == "" {
+			jobs[n].Outpath = strings.NewReplacer("{depot}", strconv.Itoa(j.Depot), "{version}", strconv.Itoa(j.Version)).Replace(template)
+		}
+	}
+
+	err = checkOutpaths(jobs)
+	if err != nil {
+		return err
+	}
+
+	workers, size := extractorBuffers(memory, workers)
+
+	fmt.Printf("Extracting %d depot versions using %d extraction workers with %d KiB buffers\n", len(jobs), workers, size/1024)
+
+	files := make(chan ExtractorJob)
+
+	var wg sync.WaitGroup
+
+	for range workers {
+		wg.Add(1)
+		go extractorWorker(&wg, files, size)
+	}
+
+	results := make([]error, len(jobs))
+
+	// depots whose files are still being written
+	var depots sync.WaitGroup
+
+	// bytes that were linked instead of written
+	var saved atomic.Int64
+	var linked atomic.Int64
+
+	bar := progressbar.Default(int64(len(jobs)), "Extracting")
+
+	for start := 0; start < len(jobs); {
+		end := start
+		for end < len(jobs) && jobs[end].Depot == jobs[start].Depot {
+			end++
+		}
+
+		queueDepot(files, jobs[start:end], results[start:end], keys, dedup, manifestdir, storagedir, manifestchecksum, bar, &depots, &linked, &saved)
+
+		start = end
+	}
+
+	close(files)
+
+	wg.Wait()
+	depots.Wait()
+
+	// report
+	var succeeded, failed int
+	for n, j := range jobs {
+		if results[n] != nil {
+			fmt.Printf("FAIL %d_%d: %s\n", j.Depot, j.Version, results[n])
+			failed++
+
+			continue
+		}
+
+		fmt.Printf("OK %d_%d -> %s\n", j.Depot, j.Version, j.Outpath)
+		succeeded++
+	}
+
+	fmt.Printf("%d succeeded, %d failed\n", succeeded, failed)
+
+	if dedup != "off" {
+		fmt.Printf("Linked %d files, saved %d bytes (%d MiB)\n", linked.Load(), saved.Load(), saved.Load()/0x100000)
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("%d depot versions failed to extract", failed)
+	}
+
+	return nil
+}
+
+// versions extracted into the same directory, or one inside another, would clobber each other
+func checkOutpaths(jobs []BatchJob) error {
+	owners := make(map[string]BatchJob)
+	for _, j := range jobs {
+		abs, err := filepath.Abs(j.Outpath)
+		if err != nil {
+			return fmt.Errorf("failed to resolve output path %s: %s", j.Outpath, err)
+		}
+
+		if o, ok := owners[abs]; ok {
+			return fmt.Errorf("depot versions %d_%d and %d_%d both extract to %s", o.Depot, o.Version, j.Depot, j.Version, j.Outpath)
+		}
+
+		owners[abs] = j
+	}
+
+	for abs, j := range owners {
+		for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+			if o, ok := owners[dir]; ok {
+				return fmt.Errorf("depot version %d_%d extracts to %s, inside %d_%d's output %s", j.Depot, j.Version, j.Outpath, o.Depot, o.Version, o.Outpath)
+			}
+
+			if dir == filepath.Dir(dir) {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// the depot's data file is closed once all of its files are written
+func queueDepot(files chan ExtractorJob, jobs []BatchJob, results []error, keys gozelle.Keys, dedup string, manifestdir string, storagedir string, manifestchecksum string, bar *progressbar.ProgressBar, depots *sync.WaitGroup, linked *atomic.Int64, saved *atomic.Int64) {
+	depot := jobs[0].Depot
+
+	fail := func(err error) {
+		for n := range jobs {
+			results[n] = err
+			bar.Add(1)
+		}
+	}
+
+	index, err := gozelle.IndexFromFile(storagedir, depot)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	data, err := gozelle.OpenData(storagedir, depot, index)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	key, ok := keys[depot]
+	if !ok {
+		log.Printf("couldn't find key for depot %d", depot)
+	}
+
+	var written sync.WaitGroup
+
+	// where each file id was first written, ids are only unique within a depot
+	var extracted map[int]*ExtractedFile
+	if dedup != "off" {
+		extracted = make(map[int]*ExtractedFile)
+	}
+
+	for n, j := range jobs {
+		written.Add(1)
+
+		err := queueVersion(files, j, &results[n], index, data, key, dedup, extracted, manifestdir, manifestchecksum, linked, saved, func() {
+			bar.Add(1)
+			written.Done()
+		})
+		if err != nil {
+			results[n] = err
+			bar.Add(1)
+			written.Done()
+		}
+	}
+
+	depots.Add(1)
+	go func() {
+		written.Wait()
+		data.Close()
+		depots.Done()
+	}()
+}
+
+// done is called once every file has been written, the first failure ends up in result
+func queueVersion(files chan ExtractorJob, job BatchJob, result *error, index gozelle.Index, data *os.File, key []byte, dedup string, extracted map[int]*ExtractedFile, manifestdir string, manifestchecksum string, linked *atomic.Int64, saved *atomic.Int64, done func()) error {
+	manifest, err := loadManifest(manifestdir, job.Depot, job.Version, manifestchecksum)
+	if err != nil {
+		return err
+	}
+
+	if int(manifest.DepotID) != job.Depot || int(manifest.DepotVersion) != job.Version {
+		return fmt.Errorf("manifest is for depot %d version %d", manifest.DepotID, manifest.DepotVersion)
+	}
+
+	// everything has to be there before anything is written
+	for _, i := range manifest.Items {
+		if i.IsDirectory() {
+			continue
+		}
+
+		if _, ok := index[int(i.ID)]; !ok {
+			return fmt.Errorf("file %s missing from index", i.Path)
+		}
+	}
+
+	for _, i := range manifest.Items {
+		if !i.IsDirectory() {
+			continue
+		}
+
+		err := os.MkdirAll(path.Join(job.Outpath, i.Path), 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create directory: %s", err)
+		}
+	}
+
+	var mu sync.Mutex
+	var written sync.WaitGroup
+
+	record := func(size uint32) func(ExtractorResult) {
+		return func(r ExtractorResult) {
+			if r.Err != nil {
+				mu.Lock()
+				if *result == nil {
+					*result = r.Err
+				}
+				mu.Unlock()
+			}
+
+			if r.Linked {
+				linked.Add(1)
+				saved.Add(int64(size))
+			}
+
+			written.Done()
+		}
+	}
+
+	for _, i := range manifest.Items {
+		if i.IsDirectory() {
+			continue
+		}
+
+		written.Add(1)
+
+		out := ExtractorJob{
+			Path:  path.Join(job.Outpath, i.Path),
+			File:  index[int(i.ID)],
+			Data:  data,
+			Key:   key,
+			Dedup: dedup,
+			Done:  record(i.Size),
+		}
+
+		if extracted != nil {
+			out.Source = extracted[int(i.ID)]
+			if out.Source == nil {
+				out.Target = NewExtractedFile(out.Path)
+				extracted[int(i.ID)] = out.Target
+			}
+		}
+
+		files <- out
+	}
+
+	go func() {
+		written.Wait()
+		done()
+	}()
+
+	return nil
+}
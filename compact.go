@@ -0,0 +1,158 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/patapancakes/exdepot/gozelle"
+	"github.com/schollz/progressbar/v3"
+)
+
+// drops everything from a depot's storage that none of its manifests use
+func doCompact(depot int, dryrun bool, manifestdir string, storagedir string, manifestchecksum string) error {
+	versions, err := findVersions(manifestdir)
+	if err != nil {
+		return err
+	}
+
+	live := make(map[int]bool)
+
+	var count int
+	for _, v := range versions {
+		if v.Depot != depot {
+			continue
+		}
+
+		manifest, err := loadManifest(manifestdir, v.Depot, v.Version, manifestchecksum)
+		if err != nil {
+			return err
+		}
+
+		for _, i := range manifest.Items {
+			if !i.IsDirectory() {
+				live[int(i.ID)] = true
+			}
+		}
+
+		count++
+	}
+
+	// without any manifests everything would be thrown away
+	if count == 0 {
+		return fmt.Errorf("no manifests found for depot %d", depot)
+	}
+
+	if !dryrun {
+		err := recoverStorage(storagedir, depot)
+		if err != nil {
+			return err
+		}
+	}
+
+	index, err := gozelle.IndexFromFile(storagedir, depot)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path.Join(storagedir, fmt.Sprintf("%d.data", depot)))
+	if err != nil {
+		return fmt.Errorf("failed to stat data file: %s", err)
+	}
+
+	var ids []int
+	var liveSize int64
+	for _, id := range slices.Sorted(maps.Keys(index)) {
+		if !live[id] {
+			continue
+		}
+
+		ids = append(ids, id)
+
+		for _, c := range index[id].Chunks {
+			liveSize += int64(c.Length)
+		}
+	}
+
+	var missing int
+	for id := range live {
+		if _, ok := index[id]; !ok {
+			missing++
+		}
+	}
+
+	if missing != 0 {
+		log.Printf("%d files used by manifests are missing from the storage", missing)
+	}
+
+	fmt.Printf("Depot %d: %d manifests, %d of %d files live\n", depot, count, len(ids), len(index))
+	fmt.Printf("Data is %d bytes, %d live, %d reclaimable (%d MiB)\n", info.Size(), liveSize, info.Size()-liveSize, (info.Size()-liveSize)/0x100000)
+
+	if dryrun {
+		return nil
+	}
+
+	data, err := gozelle.OpenData(storagedir, depot, index)
+	if err != nil {
+		return err
+	}
+
+	defer data.Close()
+
+	bar := progressbar.DefaultBytes(liveSize, "Compacting")
+
+	err = gozelle.RewriteStorage(storagedir, depot, func(w *gozelle.StorageWriter) error {
+		for _, id := range ids {
+			err := w.CopyFile(id, index[id], data)
+			if err != nil {
+				return fmt.Errorf("failed to copy file %d: %s", id, err)
+			}
+
+			for _, c := range index[id].Chunks {
+				bar.Add64(int64(c.Length))
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	checksums, err := loadChecksums(storagedir, depot)
+	if err != nil {
+		return err
+	}
+
+	if checksums == nil {
+		return nil
+	}
+
+	for id := range checksums {
+		if !live[id] {
+			delete(checksums, id)
+		}
+	}
+
+	return gozelle.ChecksumsToFile(storagedir, depot, checksums)
+}
@@ -0,0 +1,85 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/patapancakes/exdepot/gozelle"
+	"github.com/schollz/progressbar/v3"
+)
+
+// folds a gcf into the manifest and storage directories
+func doConvert(gcf string, commondir string, manifestdir string, storagedir string) error {
+	if gcf == "" {
+		return fmt.Errorf("no gcf file given")
+	}
+
+	cache, err := gozelle.GCFFromFile(gcf, commondir)
+	if err != nil {
+		return err
+	}
+
+	defer cache.Close()
+
+	manifest := cache.Manifest
+	depot := int(manifest.DepotID)
+
+	fmt.Printf("Converting depot %d version %d\n", manifest.DepotID, manifest.DepotVersion)
+
+	var added, reused int
+
+	err = appendVersion(depot, int(manifest.DepotVersion), manifestdir, storagedir, func(w *gozelle.StorageWriter, index gozelle.Index, checksums gozelle.Checksums) (gozelle.Manifest, error) {
+		bar := progressbar.Default(int64(len(cache.Index)), "Converting")
+
+		for _, id := range slices.Sorted(maps.Keys(cache.Index)) {
+			bar.Add(1)
+
+			file := cache.Index[id]
+
+			if _, ok := index[id]; ok {
+				reused++
+				continue
+			}
+
+			err := w.CopyFile(id, file, cache.Data)
+			if err != nil {
+				return manifest, fmt.Errorf("failed to copy file %d: %s", id, err)
+			}
+
+			if _, ok := checksums[id]; !ok {
+				if list, ok := cache.Checksums[id]; ok {
+					checksums[id] = list
+				}
+			}
+
+			added++
+		}
+
+		return manifest, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Added %d files, reused %d already in storage\n", added, reused)
+
+	return nil
+}
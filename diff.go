@@ -0,0 +1,268 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/patapancakes/exdepot/gozelle"
+)
+
+type ManifestDiff struct {
+	Depot    int          `json:"depot"`
+	From     int          `json:"from"`
+	To       int          `json:"to"`
+	Added    []DiffEntry  `json:"added"`
+	Removed  []DiffEntry  `json:"removed"`
+	Moved    []DiffMove   `json:"moved"`
+	Modified []DiffChange `json:"modified"`
+}
+
+type DiffEntry struct {
+	Path      string `json:"path"`
+	ID        uint32 `json:"id"`
+	Size      uint32 `json:"size"`
+	Directory bool   `json:"directory"`
+}
+
+type DiffMove struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	ID   uint32 `json:"id"`
+	Size uint32 `json:"size"`
+}
+
+type DiffChange struct {
+	Path    string   `json:"path"`
+	OldID   uint32   `json:"oldID"`
+	NewID   uint32   `json:"newID"`
+	OldSize uint32   `json:"oldSize"`
+	NewSize uint32   `json:"newSize"`
+	Reasons []string `json:"reasons"`
+}
+
+func doDiff(old gozelle.Manifest, manifest gozelle.Manifest, oldChecksums gozelle.Checksums, checksums gozelle.Checksums, outpath string, asJSON bool) error {
+	diff := diffManifests(old, manifest, oldChecksums, checksums)
+
+	w, err := createOutput(outpath)
+	if err != nil {
+		return err
+	}
+
+	if !asJSON {
+		return closeOutput(w, writeDiff(w, diff))
+	}
+
+	err = json.NewEncoder(w).Encode(diff)
+	if err != nil {
+		err = fmt.Errorf("failed to encode output json: %s", err)
+	}
+
+	return closeOutput(w, err)
+}
+
+// either set of checksums can be nil, then contents are only compared by id and size
+func diffManifests(old gozelle.Manifest, manifest gozelle.Manifest, oldChecksums gozelle.Checksums, checksums gozelle.Checksums) ManifestDiff {
+	diff := ManifestDiff{
+		Depot:    int(manifest.DepotID),
+		From:     int(old.DepotVersion),
+		To:       int(manifest.DepotVersion),
+		Added:    []DiffEntry{},
+		Removed:  []DiffEntry{},
+		Moved:    []DiffMove{},
+		Modified: []DiffChange{},
+	}
+
+	before := make(map[string]gozelle.Item)
+	for _, i := range old.Items {
+		if i.Path != "" {
+			before[i.Path] = i
+		}
+	}
+
+	after := make(map[string]gozelle.Item)
+	for _, i := range manifest.Items {
+		if i.Path != "" {
+			after[i.Path] = i
+		}
+	}
+
+	var removed, added []gozelle.Item
+
+	for _, i := range old.Items {
+		if i.Path == "" {
+			continue
+		}
+
+		n, ok := after[i.Path]
+		if !ok || n.IsDirectory() != i.IsDirectory() {
+			removed = append(removed, i)
+			continue
+		}
+
+		if i.IsDirectory() {
+			continue
+		}
+
+		var reasons []string
+		if n.ID != i.ID {
+			reasons = append(reasons, "id")
+		}
+		if n.Size != i.Size {
+			reasons = append(reasons, "size")
+		}
+		if !sameChecksums(oldChecksums[int(i.ID)], checksums[int(n.ID)]) {
+			reasons = append(reasons, "checksums")
+		}
+
+		if reasons != nil {
+			diff.Modified = append(diff.Modified, DiffChange{Path: i.Path, OldID: i.ID, NewID: n.ID, OldSize: i.Size, NewSize: n.Size, Reasons: reasons})
+		}
+	}
+
+	for _, i := range manifest.Items {
+		if i.Path == "" {
+			continue
+		}
+
+		o, ok := before[i.Path]
+		if !ok || o.IsDirectory() != i.IsDirectory() {
+			added = append(added, i)
+		}
+	}
+
+	// removed files by id, and by contents when there are checksums, in manifest order
+	byID := make(map[uint32][]int)
+	byContents := make(map[string][]int)
+	for n, r := range removed {
+		if r.IsDirectory() {
+			continue
+		}
+
+		byID[r.ID] = append(byID[r.ID], n)
+
+		if k := contentsKey(r, oldChecksums); k != "" {
+			byContents[k] = append(byContents[k], n)
+		}
+	}
+
+	moved := make([]bool, len(removed))
+
+	// first one in the list that hasn't moved yet and has the same contents
+	take := func(list []int, a gozelle.Item) int {
+		for _, n := range list {
+			if !moved[n] && sameChecksums(oldChecksums[int(removed[n].ID)], checksums[int(a.ID)]) {
+				moved[n] = true
+				return n
+			}
+		}
+
+		return -1
+	}
+
+	// a removed file with the same contents as an added one was moved
+	for _, a := range added {
+		m := -1
+		if !a.IsDirectory() {
+			m = take(byID[a.ID], a)
+			if k := contentsKey(a, checksums); m == -1 && k != "" {
+				m = take(byContents[k], a)
+			}
+		}
+
+		if m == -1 {
+			diff.Added = append(diff.Added, DiffEntry{Path: a.Path, ID: a.ID, Size: a.Size, Directory: a.IsDirectory()})
+			continue
+		}
+
+		diff.Moved = append(diff.Moved, DiffMove{From: removed[m].Path, To: a.Path, ID: a.ID, Size: a.Size})
+	}
+
+	for n, r := range removed {
+		if moved[n] {
+			continue
+		}
+
+		diff.Removed = append(diff.Removed, DiffEntry{Path: r.Path, ID: r.ID, Size: r.Size, Directory: r.IsDirectory()})
+	}
+
+	slices.SortFunc(diff.Added, func(a DiffEntry, b DiffEntry) int { return strings.Compare(a.Path, b.Path) })
+	slices.SortFunc(diff.Removed, func(a DiffEntry, b DiffEntry) int { return strings.Compare(a.Path, b.Path) })
+	slices.SortFunc(diff.Moved, func(a DiffMove, b DiffMove) int { return strings.Compare(a.To, b.To) })
+	slices.SortFunc(diff.Modified, func(a DiffChange, b DiffChange) int { return strings.Compare(a.Path, b.Path) })
+
+	return diff
+}
+
+// only differs if both sides have checksums to compare
+func sameChecksums(a []uint32, b []uint32) bool {
+	return len(a) == 0 || len(b) == 0 || slices.Equal(a, b)
+}
+
+// ids are enough, but the same data can end up under a new id, files without checksums only match by id
+func contentsKey(i gozelle.Item, checksums gozelle.Checksums) string {
+	list := checksums[int(i.ID)]
+	if len(list) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%d %x", i.Size, list)
+}
+
+func writeDiff(w io.Writer, diff ManifestDiff) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Depot %d version %d -> %d\n", diff.Depot, diff.From, diff.To)
+
+	for _, e := range diff.Added {
+		fmt.Fprintf(&b, "A %s\n", diffPath(e))
+	}
+
+	for _, e := range diff.Removed {
+		fmt.Fprintf(&b, "D %s\n", diffPath(e))
+	}
+
+	for _, m := range diff.Moved {
+		fmt.Fprintf(&b, "R %s -> %s\n", m.From, m.To)
+	}
+
+	for _, c := range diff.Modified {
+		fmt.Fprintf(&b, "M %s (%s)\n", c.Path, strings.Join(c.Reasons, ", "))
+	}
+
+	fmt.Fprintf(&b, "%d added, %d removed, %d moved, %d modified\n", len(diff.Added), len(diff.Removed), len(diff.Moved), len(diff.Modified))
+
+	_, err := io.WriteString(w, b.String())
+	if err != nil {
+		return fmt.Errorf("failed to write to output file: %s", err)
+	}
+
+	return nil
+}
+
+func diffPath(e DiffEntry) string {
+	if e.Directory {
+		return e.Path + "/"
+	}
+
+	return e.Path
+}
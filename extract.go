@@ -18,9 +18,16 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path"
+	"slices"
+	"strings"
 	"sync"
 
 	"github.com/patapancakes/exdepot/gozelle"
@@ -29,40 +36,232 @@ import (
 type ExtractorJob struct {
 	Path string
 	File *gozelle.File
+	Data io.ReaderAt
+	Key  []byte
+
+	// with dedup on, Source is an earlier copy of the same file to link to and Target is where this one ends up for later jobs
+	Dedup  string
+	Source *ExtractedFile
+	Target *ExtractedFile
+
+	// called once the file is written, or with why it couldn't be
+	Done func(result ExtractorResult)
+}
+
+type ExtractorResult struct {
+	Err    error
+	Linked bool
+
+	// crc32 of what was written, not set for linked files
+	Size     int64
+	Checksum uint32
+}
+
+type ExtractedFile struct {
+	Path string
+	Err  error
+
+	// closed once the file is written
+	Written chan struct{}
+}
+
+func NewExtractedFile(path string) *ExtractedFile {
+	return &ExtractedFile{Path: path, Written: make(chan struct{})}
+}
+
+const (
+	// rough size of the zlib and aes state for each worker
+	workerOverhead = 0x10000
+
+	minBufferSize = 0x1000
+	maxBufferSize = 0x400000
+)
+
+// splits the memory budget (in MiB) between workers, each one needs a read buffer and a copy buffer
+func extractorBuffers(memory int, workers int) (int, int) {
+	if memory <= 0 {
+		return workers, gozelle.DefaultBufferSize
+	}
+
+	budget := memory * 1024 * 1024
+
+	// fewer workers if they won't fit
+	minimum := workerOverhead + 2*minBufferSize
+	if budget/workers < minimum {
+		workers = max(budget/minimum, 1)
+	}
+
+	size := (budget/workers - workerOverhead) / 2
+
+	return workers, min(max(size, minBufferSize), maxBufferSize)
 }
 
-func extractorWorker(wg *sync.WaitGroup, jobs chan ExtractorJob, data io.ReaderAt, key []byte) {
+func extractorWorker(wg *sync.WaitGroup, jobs chan ExtractorJob, size int) {
 	defer wg.Done()
 
+	buf := make([]byte, size)
+
 	for {
 		job, ok := <-jobs
 		if !ok {
 			break
 		}
 
-		out, err := os.OpenFile(job.Path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
-		if err != nil {
-			log.Fatalf("failed to open output file: %s", err)
+		// the source was queued first so it's already being written
+		if job.Source != nil {
+			<-job.Source.Written
+
+			if job.Source.Err == nil && linkFile(job.Source.Path, job.Path, job.Dedup) == nil {
+				job.Done(ExtractorResult{Linked: true})
+				continue
+			}
 		}
 
-		err = job.File.Prepare(key, data)
-		if err != nil {
-			log.Fatalf("failed to prepare file for reading: %s", err)
+		result := extractFile(job, buf, size)
+
+		if job.Target != nil {
+			job.Target.Err = result.Err
+			close(job.Target.Written)
 		}
 
-		_, err = io.Copy(out, job.File)
-		if err != nil {
-			log.Fatalf("failed to extract cache file: %s", err)
+		job.Done(result)
+	}
+}
+
+func checkDedup(dedup string) error {
+	if dedup != "off" && dedup != "hardlink" && dedup != "reflink" && dedup != "auto" {
+		return fmt.Errorf("unknown dedup method %s", dedup)
+	}
+
+	return nil
+}
+
+// auto tries a reflink first since hardlinked files can't be changed on their own
+func linkFile(src string, dst string, dedup string) error {
+	switch dedup {
+	case "hardlink":
+		return hardlink(src, dst)
+	case "reflink":
+		return reflink(src, dst)
+	case "auto":
+		err := reflink(src, dst)
+		if err == nil {
+			return nil
 		}
 
-		err = out.Sync()
-		if err != nil {
-			log.Fatalf("failed to sync output file: %s", err)
+		return hardlink(src, dst)
+	}
+
+	return fmt.Errorf("unknown dedup method %s", dedup)
+}
+
+func hardlink(src string, dst string) error {
+	err := os.Remove(dst)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove output file: %s", err)
+	}
+
+	err = os.Link(src, dst)
+	if err != nil {
+		return fmt.Errorf("failed to link file: %s", err)
+	}
+
+	return nil
+}
+
+func extractFile(job ExtractorJob, buf []byte, size int) ExtractorResult {
+	// whatever is there may be hardlinked to another version, so it's replaced instead of written through
+	err := os.Remove(job.Path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return ExtractorResult{Err: fmt.Errorf("failed to remove output file: %s", err)}
+	}
+
+	out, err := os.OpenFile(job.Path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return ExtractorResult{Err: fmt.Errorf("failed to open output file: %s", err)}
+	}
+
+	defer out.Close()
+
+	// files can be shared between depot versions, so they aren't prepared in place
+	r := job.File.NewReader(job.Key, job.Data, size)
+	defer r.Close()
+
+	crc := crc32.NewIEEE()
+
+	n, err := io.CopyBuffer(io.MultiWriter(out, crc), r, buf)
+	if err != nil {
+		return ExtractorResult{Err: fmt.Errorf("failed to extract cache file: %s", err)}
+	}
+
+	err = out.Sync()
+	if err != nil {
+		return ExtractorResult{Err: fmt.Errorf("failed to sync output file: %s", err)}
+	}
+
+	err = out.Close()
+	if err != nil {
+		return ExtractorResult{Err: fmt.Errorf("failed to close output file: %s", err)}
+	}
+
+	return ExtractorResult{Size: n, Checksum: crc.Sum32()}
+}
+
+// deletes whatever the previous version had that the new one doesn't, and returns the paths that can be kept as they are
+func removeStale(outpath string, previous gozelle.Manifest, manifest gozelle.Manifest) (map[string]bool, int, error) {
+	current := make(map[string]gozelle.Item)
+	for _, i := range manifest.Items {
+		current[i.Path] = i
+	}
+
+	// deepest first so directories are empty by the time they're removed
+	items := slices.Clone(previous.Items)
+	slices.SortStableFunc(items, func(a gozelle.Item, b gozelle.Item) int {
+		return strings.Count(b.Path, "/") - strings.Count(a.Path, "/")
+	})
+
+	unchanged := make(map[string]bool)
+
+	var removed int
+	for _, i := range items {
+		if i.Path == "" {
+			continue
 		}
 
-		err = out.Close()
-		if err != nil {
-			log.Fatalf("failed to close output file: %s", err)
+		name := path.Join(outpath, i.Path)
+
+		c, ok := current[i.Path]
+		if ok && c.IsDirectory() && i.IsDirectory() {
+			continue
 		}
+
+		if i.IsDirectory() {
+			// anything that isn't from the depot is left alone
+			err := os.Remove(name)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("couldn't remove directory %s: %s", name, err)
+			}
+
+			continue
+		}
+
+		// same file id means same contents, as long as it's still there
+		if ok && !c.IsDirectory() && c.ID == i.ID && c.Size == i.Size {
+			info, err := os.Stat(name)
+			if err == nil && info.Mode().IsRegular() && info.Size() == int64(c.Size) {
+				unchanged[i.Path] = true
+				continue
+			}
+		}
+
+		// changed files are removed too so nothing gets written through a hardlink
+		err := os.Remove(name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, removed, fmt.Errorf("failed to remove %s: %s", name, err)
+		}
+
+		removed++
 	}
+
+	return unchanged, removed, nil
 }
@@ -0,0 +1,101 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/patapancakes/exdepot/gozelle"
+)
+
+// repeatable glob flag
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *patternList) Set(pattern string) error {
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return fmt.Errorf("invalid pattern %s: %s", pattern, err)
+	}
+
+	*l = append(*l, pattern)
+
+	return nil
+}
+
+// patterns match the path or any directory above it, ones without a slash only match the last name
+func matchesAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		base := !strings.Contains(pattern, "/")
+
+		for dir := p; dir != "." && dir != "/"; dir = path.Dir(dir) {
+			name := dir
+			if base {
+				name = path.Base(dir)
+			}
+
+			ok, _ := path.Match(pattern, name)
+			if ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// files that pass the filters, and the directories they need
+func selectItems(manifest gozelle.Manifest, include []string, exclude []string) []bool {
+	selected := make([]bool, len(manifest.Items))
+
+	// no filters keeps empty directories too
+	if len(include) == 0 && len(exclude) == 0 {
+		for n := range selected {
+			selected[n] = true
+		}
+
+		return selected
+	}
+
+	for n, i := range manifest.Items {
+		if i.IsDirectory() {
+			continue
+		}
+
+		if len(include) != 0 && !matchesAny(include, i.Path) {
+			continue
+		}
+
+		if matchesAny(exclude, i.Path) {
+			continue
+		}
+
+		selected[n] = true
+
+		for p := i.ParentIndex; p != 0xFFFFFFFF && int(p) < len(selected) && !selected[p]; p = manifest.Items[p].ParentIndex {
+			selected[p] = true
+		}
+	}
+
+	return selected
+}
@@ -2,11 +2,13 @@ module github.com/patapancakes/exdepot
 
 go 1.23.0
 
-require github.com/schollz/progressbar/v3 v3.14.6
+require (
+	github.com/schollz/progressbar/v3 v3.14.6
+	golang.org/x/sys v0.24.0
+)
 
 require (
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	golang.org/x/sys v0.24.0 // indirect
 	golang.org/x/term v0.23.0 // indirect
 )
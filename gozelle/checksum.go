@@ -0,0 +1,267 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gozelle
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+)
+
+const checksumFormatCode = 0x14893721
+
+type Checksums map[int][]uint32
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+func ChecksumsFromFile(storagedir string, depot int) (Checksums, error) {
+	file, err := os.Open(path.Join(storagedir, fmt.Sprintf("%d.checksums", depot)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checksums file: %s", err)
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat checksums file: %s", err)
+	}
+
+	checksums, err := checksumsFromReader(bufio.NewReader(file), info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checksums: %s", err)
+	}
+
+	return checksums, nil
+}
+
+// size is how much there is to read, the counts in the header are checked against it before anything is allocated
+func checksumsFromReader(r io.Reader, size int64) (Checksums, error) {
+	v, err := readUint32List(r, 4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read value: %s", err)
+	}
+
+	if v[0] != checksumFormatCode {
+		return nil, fmt.Errorf("unknown format code %#x", v[0])
+	}
+
+	numFiles := v[2]
+	numChecksums := v[3]
+
+	if 16+uint64(numFiles)*8+uint64(numChecksums)*4 > uint64(max(size, 0)) {
+		return nil, fmt.Errorf("header says %d files and %d checksums, but there are only %d bytes", numFiles, numChecksums, size)
+	}
+
+	// count and first checksum index for each file id
+	entries, err := readUint32List(r, int(numFiles)*2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file entries: %s", err)
+	}
+
+	table, err := readUint32List(r, int(numChecksums))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checksum table: %s", err)
+	}
+
+	// the signature that follows isn't checked
+
+	checksums := make(Checksums)
+
+	for id := range int(numFiles) {
+		count := entries[id*2]
+		first := entries[id*2+1]
+
+		if uint64(first)+uint64(count) > uint64(len(table)) {
+			return nil, fmt.Errorf("checksums for file %d are out of range", id)
+		}
+
+		checksums[id] = table[first : first+count]
+	}
+
+	return checksums, nil
+}
+
+// steam doesn't use the standard adler32 starting value
+func Checksum(data []byte) uint32 {
+	return adler32(0, data) ^ crc32.ChecksumIEEE(data)
+}
+
+func (c Checksums) Verify(id int, r io.Reader, blockSize uint32) error {
+	list, ok := c[id]
+	if !ok {
+		return fmt.Errorf("no checksums for file %d", id)
+	}
+
+	if blockSize == 0 {
+		return fmt.Errorf("invalid block size")
+	}
+
+	block := make([]byte, blockSize)
+
+	var n int
+	for {
+		read, err := io.ReadFull(r, block)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to read block %d: %s", n, err)
+		}
+
+		if n >= len(list) {
+			return fmt.Errorf("file has more blocks than checksums (%d)", len(list))
+		}
+
+		if Checksum(block[:read]) != list[n] {
+			return fmt.Errorf("block %d: %w", n, ErrChecksumMismatch)
+		}
+
+		n++
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	// empty files can still have a single checksum
+	if n == 0 && len(list) == 1 && list[0] == Checksum(nil) {
+		return nil
+	}
+
+	if n != len(list) {
+		return fmt.Errorf("file has %d blocks but %d checksums", n, len(list))
+	}
+
+	return nil
+}
+
+// checksums a stream one block at a time
+type checksumWriter struct {
+	block     []byte
+	size      int
+	checksums []uint32
+}
+
+func newChecksumWriter(blockSize uint32) *checksumWriter {
+	return &checksumWriter{block: make([]byte, blockSize)}
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) != 0 {
+		copied := copy(w.block[w.size:], p)
+		w.size += copied
+		p = p[copied:]
+
+		if w.size == len(w.block) {
+			w.checksums = append(w.checksums, Checksum(w.block))
+			w.size = 0
+		}
+	}
+
+	return n, nil
+}
+
+func (w *checksumWriter) Sum() []uint32 {
+	if w.size != 0 {
+		w.checksums = append(w.checksums, Checksum(w.block[:w.size]))
+		w.size = 0
+	}
+
+	return w.checksums
+}
+
+// written to a temporary file first so the old one survives a failure
+func ChecksumsToFile(storagedir string, depot int, checksums Checksums) error {
+	name := path.Join(storagedir, fmt.Sprintf("%d.checksums", depot))
+
+	file, err := os.OpenFile(name+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open checksums file: %s", err)
+	}
+
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+
+	err = checksumsToWriter(w, checksums)
+	if err != nil {
+		return fmt.Errorf("failed to write checksums: %s", err)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write checksums: %s", err)
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync checksums file: %s", err)
+	}
+
+	err = os.Rename(name+".tmp", name)
+	if err != nil {
+		return fmt.Errorf("failed to replace checksums file: %s", err)
+	}
+
+	return nil
+}
+
+// ids without checksums are written with none, the signature is left empty
+func checksumsToWriter(w io.Writer, checksums Checksums) error {
+	numFiles := 0
+	numChecksums := 0
+	for id, list := range checksums {
+		numFiles = max(numFiles, id+1)
+		numChecksums += len(list)
+	}
+
+	err := writeUint32List(w, checksumFormatCode, 1, uint32(numFiles), uint32(numChecksums))
+	if err != nil {
+		return err
+	}
+
+	var first uint32
+	for id := range numFiles {
+		count := uint32(len(checksums[id]))
+
+		err := writeUint32List(w, count, first)
+		if err != nil {
+			return err
+		}
+
+		first += count
+	}
+
+	for id := range numFiles {
+		err := writeUint32List(w, checksums[id]...)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = w.Write(make([]byte, gcfChecksumSignatureSize))
+
+	return err
+}
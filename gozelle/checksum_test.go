@@ -0,0 +1,50 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gozelle
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChecksumsCorruptCounts(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := checksumsToWriter(&buf, Checksums{0: {1, 2}, 1: {3}})
+	if err != nil {
+		t.Fatalf("failed to write checksums: %s", err)
+	}
+
+	good := buf.Bytes()
+
+	_, err = checksumsFromReader(bytes.NewReader(good), int64(len(good)))
+	if err != nil {
+		t.Fatalf("failed to read checksums: %s", err)
+	}
+
+	// file and checksum counts that would need gigabytes
+	for _, field := range []int{8, 12} {
+		bad := bytes.Clone(good)
+		copy(bad[field:], []byte{0xff, 0xff, 0xff, 0x7f})
+
+		_, err := checksumsFromReader(bytes.NewReader(bad), int64(len(bad)))
+		if err == nil {
+			t.Fatalf("read checksums with a corrupt count at %d", field)
+		}
+	}
+}
@@ -18,6 +18,7 @@
 package gozelle
 
 import (
+	"bufio"
 	"bytes"
 	"compress/zlib"
 	"crypto/aes"
@@ -36,6 +37,9 @@ type Chunk struct {
 
 var ErrChunkNotPrepared = errors.New("chunk not prepared")
 
+// read buffer size for each chunk being decoded
+const DefaultBufferSize = 0x10000
+
 func (c Chunk) Read(dst []byte) (int, error) {
 	if c.Length == 0 {
 		return 0, io.EOF
@@ -54,25 +58,30 @@ func (c Chunk) Read(dst []byte) (int, error) {
 }
 
 func (c *Chunk) Prepare(key []byte, src io.ReaderAt, mode Mode) error {
-	// why do zero-length chunks exist?
-	if c.Length == 0 {
-		return nil
+	r, err := c.NewReader(key, src, mode, DefaultBufferSize)
+	if err != nil {
+		return err
 	}
 
-	chunk := make([]byte, c.Length)
-	_, err := src.ReadAt(chunk, int64(c.Offset))
-	if err != nil {
-		return fmt.Errorf("failed to read data: %s", err)
+	c.data = r
+
+	return nil
+}
+
+func (c Chunk) NewReader(key []byte, src io.ReaderAt, mode Mode, size int) (io.ReadCloser, error) {
+	// why do zero-length chunks exist?
+	if c.Length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
 	}
 
-	c.data = bytes.NewReader(chunk)
+	var r io.Reader = bufio.NewReaderSize(io.NewSectionReader(src, int64(c.Offset), int64(c.Length)), size)
 
 	// zlib buffer sizes if encrypted, not used
 	//var encSize, decSize uint32
 	if mode == EncryptedCompressed {
-		_, err := readUint32List(c.data, 2)
+		_, err := readUint32List(r, 2)
 		if err != nil {
-			return fmt.Errorf("failed to read value: %s", err)
+			return nil, fmt.Errorf("failed to read value: %s", err)
 		}
 
 		//encSize = v[0] // unused
@@ -82,47 +91,176 @@ func (c *Chunk) Prepare(key []byte, src io.ReaderAt, mode Mode) error {
 	// decrypt
 	if mode == EncryptedCompressed || mode == Encrypted {
 		if key == nil {
-			return fmt.Errorf("missing decryption key")
+			return nil, fmt.Errorf("missing decryption key")
 		}
 
-		data := make([]byte, c.Length)
-		_, err = c.data.Read(data)
+		ci, err := aes.NewCipher(key)
 		if err != nil {
-			return fmt.Errorf("failed to read data: %s", err)
+			return nil, fmt.Errorf("failed to create aes cipher: %s", err)
 		}
 
-		// doesn't seem like this is needed
-		//if len(data)%0x10 != 0 {
-		//	data = append(data, make([]byte, len(data)%0x10)...)
-		//}
+		// any padding at the end is left for zlib to ignore
+		r = cipher.StreamReader{S: cipher.NewCFBDecrypter(ci, make([]byte, 0x10)), R: r}
+	}
 
-		ci, err := aes.NewCipher(key)
+	// decompress
+	if mode == EncryptedCompressed || mode == Compressed {
+		zr, err := zlib.NewReader(r)
 		if err != nil {
-			return fmt.Errorf("failed to create aes cipher: %s", err)
+			return nil, fmt.Errorf("failed to create zlib reader: %s", err)
 		}
 
-		cipher.NewCFBDecrypter(ci, make([]byte, 0x10)).XORKeyStream(data, data)
+		return zr, nil
+	}
 
-		// doesn't seem like this is needed either
-		//if mode == Encrypted {
-		//	data = data[:c.Length]
-		//}
+	return io.NopCloser(r), nil
+}
 
-		c.data = bytes.NewReader(data)
+// the reverse of NewReader, level is the zlib compression level
+func EncodeChunk(data []byte, key []byte, mode Mode, level int) ([]byte, error) {
+	if mode == Raw {
+		return bytes.Clone(data), nil
 	}
 
-	// decompress
+	out := data
+
+	// compress
 	if mode == EncryptedCompressed || mode == Compressed {
-		zr, err := zlib.NewReader(c.data)
+		var buf bytes.Buffer
+
+		zw, err := zlib.NewWriterLevel(&buf, level)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zlib writer: %s", err)
+		}
+
+		_, err = zw.Write(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress data: %s", err)
+		}
+
+		err = zw.Close()
 		if err != nil {
-			return fmt.Errorf("failed to create zlib reader: %s", err)
+			return nil, fmt.Errorf("failed to compress data: %s", err)
 		}
 
-		// don't close since we're storing it for later
-		//defer zr.Close()
+		out = buf.Bytes()
+	}
 
-		c.data = zr
+	if mode == Compressed {
+		return out, nil
 	}
 
-	return nil
+	return encryptChunk(out, key, mode, uint32(len(data)))
+}
+
+// compressed size and decompressed size, then the encrypted data padded to the aes block size
+func encryptChunk(data []byte, key []byte, mode Mode, decSize uint32) ([]byte, error) {
+	if key == nil {
+		return nil, fmt.Errorf("missing encryption key")
+	}
+
+	ci, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aes cipher: %s", err)
+	}
+
+	var header []byte
+	out := bytes.Clone(data)
+
+	if mode == EncryptedCompressed {
+		var buf bytes.Buffer
+
+		err := writeUint32List(&buf, uint32(len(data)), decSize)
+		if err != nil {
+			return nil, err
+		}
+
+		header = buf.Bytes()
+		out = append(out, make([]byte, (aes.BlockSize-len(out)%aes.BlockSize)%aes.BlockSize)...)
+	}
+
+	cipher.NewCFBEncrypter(ci, make([]byte, 0x10)).XORKeyStream(out, out)
+
+	return append(header, out...), nil
+}
+
+func decryptChunk(data []byte, key []byte) ([]byte, error) {
+	if key == nil {
+		return nil, fmt.Errorf("missing decryption key")
+	}
+
+	ci, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aes cipher: %s", err)
+	}
+
+	out := make([]byte, len(data))
+
+	cipher.NewCFBDecrypter(ci, make([]byte, 0x10)).XORKeyStream(out, data)
+
+	return out, nil
+}
+
+// changes how an encoded chunk is encrypted without recompressing it, so the compression has to stay the same
+func RekeyChunk(chunk []byte, key []byte, mode Mode, newKey []byte, newMode Mode) ([]byte, error) {
+	compressed := mode == Compressed || mode == EncryptedCompressed
+	if compressed != (newMode == Compressed || newMode == EncryptedCompressed) {
+		return nil, fmt.Errorf("can't change %s to %s without recompressing", mode, newMode)
+	}
+
+	// zero-length chunks decode the same in every mode
+	if len(chunk) == 0 {
+		return nil, nil
+	}
+
+	plain := chunk
+
+	var decSize uint32
+	switch mode {
+	case EncryptedCompressed:
+		v, err := readUint32List(bytes.NewReader(chunk), 2)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read value: %s", err)
+		}
+
+		decSize = v[1]
+
+		plain, err = decryptChunk(chunk[8:], key)
+		if err != nil {
+			return nil, err
+		}
+
+		// drop the padding
+		plain = plain[:min(len(plain), int(v[0]))]
+	case Encrypted:
+		var err error
+		plain, err = decryptChunk(chunk, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch newMode {
+	case EncryptedCompressed:
+		// the header needs the decompressed size
+		if mode != EncryptedCompressed {
+			zr, err := zlib.NewReader(bytes.NewReader(plain))
+			if err != nil {
+				return nil, fmt.Errorf("failed to create zlib reader: %s", err)
+			}
+
+			n, err := io.Copy(io.Discard, zr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decompress chunk: %s", err)
+			}
+
+			decSize = uint32(n)
+		}
+
+		return encryptChunk(plain, newKey, newMode, decSize)
+	case Encrypted:
+		return encryptChunk(plain, newKey, newMode, 0)
+	}
+
+	return bytes.Clone(plain), nil
 }
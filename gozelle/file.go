@@ -18,30 +18,104 @@
 package gozelle
 
 import (
+	"fmt"
 	"io"
+	"sync"
 )
 
 type File struct {
 	Chunks []Chunk `json:"chunks"`
 	Mode   Mode    `json:"mode"`
+
+	reader io.ReadCloser
+
+	// decoded offset of each chunk, worked out on first seek for each block size and file size
+	mu      sync.Mutex
+	offsets map[offsetsKey][]int64
 }
 
 func (f *File) Read(dst []byte) (int, error) {
-	var readers []io.Reader
-	for _, c := range f.Chunks {
-		readers = append(readers, c)
+	if f.reader == nil {
+		return 0, ErrChunkNotPrepared
 	}
 
-	return io.MultiReader(readers...).Read(dst)
+	return f.reader.Read(dst)
 }
 
 func (f *File) Prepare(key []byte, src io.ReaderAt) error {
-	for i := range f.Chunks {
-		err := f.Chunks[i].Prepare(key, src, f.Mode)
-		if err != nil {
-			return err
-		}
+	return f.PrepareBuffer(key, src, DefaultBufferSize)
+}
+
+// chunks are decoded one at a time as they're read
+func (f *File) PrepareBuffer(key []byte, src io.ReaderAt, size int) error {
+	if f.reader != nil {
+		f.reader.Close()
+	}
+
+	if (f.Mode == EncryptedCompressed || f.Mode == Encrypted) && key == nil {
+		return fmt.Errorf("missing decryption key")
 	}
 
+	f.reader = f.NewReader(key, src, size)
+
 	return nil
 }
+
+// unlike Prepare, each reader has its own state
+func (f *File) NewReader(key []byte, src io.ReaderAt, size int) io.ReadCloser {
+	return &fileReader{chunks: f.Chunks, mode: f.Mode, key: key, src: src, size: size}
+}
+
+type fileReader struct {
+	chunks []Chunk
+	mode   Mode
+	key    []byte
+	src    io.ReaderAt
+	size   int
+
+	current io.ReadCloser
+}
+
+func (r *fileReader) Read(dst []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+
+			current, err := r.chunks[0].NewReader(r.key, r.src, r.mode, r.size)
+			if err != nil {
+				return 0, err
+			}
+
+			r.chunks = r.chunks[1:]
+			r.current = current
+		}
+
+		n, err := r.current.Read(dst)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (r *fileReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+
+	err := r.current.Close()
+	r.current = nil
+	r.chunks = nil
+
+	return err
+}
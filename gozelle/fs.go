@@ -0,0 +1,268 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gozelle
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"time"
+)
+
+// read-only view of a depot version
+type FS struct {
+	manifest Manifest
+	index    Index
+	data     io.ReaderAt
+	key      []byte
+
+	paths    map[string]int
+	children map[int][]int
+}
+
+var (
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.ReadFileFS = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+)
+
+func NewFS(manifest Manifest, index Index, data io.ReaderAt, key []byte) *FS {
+	fsys := &FS{
+		manifest: manifest,
+		index:    index,
+		data:     data,
+		key:      key,
+		paths:    make(map[string]int),
+		children: make(map[int][]int),
+	}
+
+	for n, i := range manifest.Items {
+		if n == 0 || i.ParentIndex == 0xFFFFFFFF {
+			continue
+		}
+
+		if int(i.ParentIndex) >= len(manifest.Items) {
+			continue
+		}
+
+		// first one wins if there are duplicates
+		if _, ok := fsys.paths[i.Path]; ok {
+			continue
+		}
+
+		fsys.paths[i.Path] = n
+		fsys.children[int(i.ParentIndex)] = append(fsys.children[int(i.ParentIndex)], n)
+	}
+
+	// fs.ReadDir expects entries sorted by name
+	for _, c := range fsys.children {
+		slices.SortFunc(c, func(a int, b int) int {
+			return strings.Compare(manifest.Items[a].Name, manifest.Items[b].Name)
+		})
+	}
+
+	return fsys
+}
+
+func (fsys *FS) lookup(op string, name string) (int, error) {
+	if !fs.ValidPath(name) {
+		return 0, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		return 0, nil
+	}
+
+	i, ok := fsys.paths[name]
+	if !ok {
+		return 0, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+
+	return i, nil
+}
+
+func (fsys *FS) info(i int) fileInfo {
+	if len(fsys.manifest.Items) == 0 {
+		return fileInfo{name: ".", dir: true}
+	}
+
+	item := fsys.manifest.Items[i]
+
+	info := fileInfo{name: item.Name, dir: item.IsDirectory()}
+	if i == 0 {
+		info.name = "."
+	}
+
+	if !info.dir {
+		info.size = int64(item.Size)
+	}
+
+	return info
+}
+
+func (fsys *FS) entries(i int) []fs.DirEntry {
+	var entries []fs.DirEntry
+	for _, c := range fsys.children[i] {
+		entries = append(entries, fsys.info(c))
+	}
+
+	return entries
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	i, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info := fsys.info(i)
+
+	if info.dir {
+		return &dir{info: info, path: name, entries: fsys.entries(i)}, nil
+	}
+
+	item := fsys.manifest.Items[i]
+
+	file, ok := fsys.index[int(item.ID)]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("file %d missing from index", item.ID)}
+	}
+
+	return &openFile{info: info, FileReader: file.NewReadSeeker(fsys.key, fsys.data, fsys.manifest.BlockSize, int64(item.Size))}, nil
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	i, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.info(i), nil
+}
+
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	i, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fsys.info(i).dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	return fsys.entries(i), nil
+}
+
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+
+	data := make([]byte, info.Size())
+
+	_, err = io.ReadFull(file, data)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+
+	return data, nil
+}
+
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i fileInfo) Name() string               { return i.name }
+func (i fileInfo) Size() int64                { return i.size }
+func (i fileInfo) ModTime() time.Time         { return time.Time{} }
+func (i fileInfo) IsDir() bool                { return i.dir }
+func (i fileInfo) Sys() any                   { return nil }
+func (i fileInfo) Type() fs.FileMode          { return i.Mode().Type() }
+func (i fileInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+func (i fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+
+	return 0444
+}
+
+type openFile struct {
+	*FileReader
+
+	info fileInfo
+}
+
+func (f *openFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+type dir struct {
+	info    fileInfo
+	path    string
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: errors.New("is a directory")}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return slices.Clone(remaining), nil
+	}
+
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(remaining))
+	d.offset += n
+
+	return slices.Clone(remaining[:n]), nil
+}
@@ -0,0 +1,46 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gozelle
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	tree := testTree()
+	manifest, index, data, _ := testPack(t, tree, EncryptedCompressed)
+
+	fsys := NewFS(manifest, index, data, testKey)
+
+	err := fstest.TestFS(fsys, slices.Sorted(maps.Keys(tree))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCompareTree(t, fsys, tree)
+}
+
+func TestFSEmpty(t *testing.T) {
+	err := fstest.TestFS(NewFS(Manifest{}, nil, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gozelle
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+const testBlockSize = 0x1000
+
+// a bit of everything, empty files and directories, files spanning several
+// blocks (and several gcf blocks), and nesting
+func testTree() fstest.MapFS {
+	return fstest.MapFS{
+		"empty.txt":                {Data: []byte{}},
+		"small.txt":                {Data: []byte("hello")},
+		"block.bin":                {Data: testData(testBlockSize)},
+		"multi.bin":                {Data: testData(testBlockSize*5 + 0x123)},
+		"big.bin":                  {Data: testData(0x12345)},
+		"dir/a.txt":                {Data: testData(0x300)},
+		"dir/empty":                {Mode: fs.ModeDir},
+		"dir/sub/nested.bin":       {Data: testData(testBlockSize*2 + 1)},
+		"dir/sub/deeper/empty.bin": {Data: []byte{}},
+	}
+}
+
+// packs a tree into an in-memory storage
+func testPack(t *testing.T, tree fs.FS, mode Mode) (Manifest, Index, *bytes.Reader, Checksums) {
+	t.Helper()
+
+	var index, data bytes.Buffer
+
+	storage := NewStorageWriter(&index, &data, 0)
+
+	manifest, checksums, err := Pack(tree, storage, PackOptions{DepotID: 1, DepotVersion: 1, BlockSize: testBlockSize, Mode: mode, Key: testKey, Level: 9})
+	if err != nil {
+		t.Fatalf("failed to pack: %s", err)
+	}
+
+	err = storage.Flush()
+	if err != nil {
+		t.Fatalf("failed to flush storage: %s", err)
+	}
+
+	idx, err := indexFromReader(&index)
+	if err != nil {
+		t.Fatalf("failed to read index: %s", err)
+	}
+
+	return manifest, idx, bytes.NewReader(data.Bytes()), checksums
+}
+
+// checks that fsys holds exactly what's in tree
+func testCompareTree(t *testing.T, fsys fs.FS, tree fstest.MapFS) {
+	t.Helper()
+
+	var want, got []string
+
+	walk := func(fsys fs.FS, names *[]string) {
+		err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if d.IsDir() {
+				name += "/"
+			}
+
+			*names = append(*names, name)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to walk: %s", err)
+		}
+	}
+
+	walk(tree, &want)
+	walk(fsys, &got)
+
+	if !slices.Equal(got, want) {
+		t.Fatalf("got tree %q, want %q", got, want)
+	}
+
+	for name, f := range tree {
+		if f.Mode.IsDir() {
+			continue
+		}
+
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", name, err)
+		}
+
+		if !bytes.Equal(data, f.Data) {
+			t.Fatalf("%s: got %d bytes, want %d, or contents differ", name, len(data), len(f.Data))
+		}
+	}
+}
+
+func TestGCFRoundTrip(t *testing.T) {
+	tests := []struct {
+		mode           Mode
+		keepEncryption bool
+	}{
+		{Raw, false},
+		{Compressed, false},
+		{EncryptedCompressed, false},
+		{EncryptedCompressed, true},
+		{Encrypted, false},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s/%t", test.mode, test.keepEncryption), func(t *testing.T) {
+			tree := testTree()
+			manifest, index, data, checksums := testPack(t, tree, test.mode)
+
+			name := path.Join(t.TempDir(), "test.gcf")
+
+			f, err := os.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = WriteGCF(f, manifest, index, data, testKey, test.keepEncryption)
+			if err != nil {
+				t.Fatalf("failed to write gcf: %s", err)
+			}
+
+			err = f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gcf, err := GCFFromFile(name, "")
+			if err != nil {
+				t.Fatalf("failed to read gcf: %s", err)
+			}
+
+			defer gcf.Close()
+
+			if len(gcf.Manifest.Items) != len(manifest.Items) {
+				t.Fatalf("got %d items, want %d", len(gcf.Manifest.Items), len(manifest.Items))
+			}
+
+			for n, i := range manifest.Items {
+				got := gcf.Manifest.Items[n]
+				if got.Path != i.Path || got.Size != i.Size || got.ID != i.ID || got.ParentIndex != i.ParentIndex {
+					t.Fatalf("item %d: got %+v, want %+v", n, got, i)
+				}
+			}
+
+			for id, list := range checksums {
+				if !slices.Equal(gcf.Checksums[id], list) {
+					t.Fatalf("file %d: got checksums %x, want %x", id, gcf.Checksums[id], list)
+				}
+			}
+
+			testCompareTree(t, NewFS(gcf.Manifest, gcf.Index, gcf.Data, testKey), tree)
+		})
+	}
+}
@@ -0,0 +1,420 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gozelle
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// a gcf or ncf cache file presented like a manifest and storage
+type GCF struct {
+	Manifest  Manifest
+	Index     Index
+	Checksums Checksums
+
+	// file contents laid out one after another, the index points into this
+	Data io.ReaderAt
+
+	closers []io.Closer
+}
+
+const (
+	gcfMajorVersion = 1
+	ncfMajorVersion = 2
+)
+
+type gcfBlockEntry struct {
+	flags      uint32
+	dataOffset uint32
+	dataSize   uint32
+	firstBlock uint32
+	next       uint32
+	previous   uint32
+	item       uint32
+}
+
+// commondir is only needed for ncf files, it's where their contents are installed
+func GCFFromFile(name string, commondir string) (*GCF, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache file: %s", err)
+	}
+
+	gcf, err := gcfFromReader(file, commondir)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read cache file: %s", err)
+	}
+
+	gcf.closers = append(gcf.closers, file)
+
+	return gcf, nil
+}
+
+func (g *GCF) Close() error {
+	var errs []error
+	for _, c := range g.closers {
+		errs = append(errs, c.Close())
+	}
+
+	g.closers = nil
+
+	return errors.Join(errs...)
+}
+
+func gcfFromReader(f io.ReaderAt, commondir string) (*GCF, error) {
+	r := bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))
+
+	header, err := readUint32List(r, 11)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %s", err)
+	}
+
+	major := header[1]
+	minor := header[2]
+	blockSize := header[8]
+	blockCount := header[9]
+
+	var entries []gcfBlockEntry
+	var fragmentation []uint32
+	var terminator uint32
+
+	switch major {
+	case gcfMajorVersion:
+		if minor != 3 && minor != 5 && minor != 6 {
+			return nil, fmt.Errorf("unsupported gcf version %d", minor)
+		}
+
+		// block entries
+		_, err = readUint32List(r, 8)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read block entry header: %s", err)
+		}
+
+		entries = make([]gcfBlockEntry, blockCount)
+		for i := range entries {
+			v, err := readUint32List(r, 7)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read block entry: %s", err)
+			}
+
+			entries[i] = gcfBlockEntry{flags: v[0], dataOffset: v[1], dataSize: v[2], firstBlock: v[3], next: v[4], previous: v[5], item: v[6]}
+		}
+
+		// fragmentation map
+		v, err := readUint32List(r, 4)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fragmentation map header: %s", err)
+		}
+
+		terminator = 0xFFFF
+		if v[2] == 1 {
+			terminator = 0xFFFFFFFF
+		}
+
+		fragmentation, err = readUint32List(r, int(blockCount))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fragmentation map: %s", err)
+		}
+
+		// block entry map, not needed
+		if minor < 6 {
+			_, err = readUint32List(r, 5+int(blockCount)*2)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read block entry map: %s", err)
+			}
+		}
+	case ncfMajorVersion:
+		// no blocks, the files live in the common folder
+	default:
+		return nil, fmt.Errorf("unknown cache file type %d", major)
+	}
+
+	// directory, the same format as a manifest
+	dirHeader, err := r.Peek(56)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory header: %s", err)
+	}
+
+	dirSize := uint32(dirHeader[24]) | uint32(dirHeader[25])<<8 | uint32(dirHeader[26])<<16 | uint32(dirHeader[27])<<24
+
+	directory := make([]byte, dirSize)
+
+	_, err = io.ReadFull(r, directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %s", err)
+	}
+
+	manifest, err := manifestFromReader(bytes.NewReader(directory))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %s", err)
+	}
+
+	// directory map, ncf files have something with the same layout
+	var directoryMap []uint32
+	if major == ncfMajorVersion || minor >= 5 {
+		v, err := readUint32List(r, 2+len(manifest.Items))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read directory map: %s", err)
+		}
+
+		directoryMap = v[2:]
+	}
+
+	// checksums
+	v, err := readUint32List(r, 2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checksum header: %s", err)
+	}
+
+	cr := io.LimitReader(r, int64(v[1]))
+
+	checksums, err := checksumsFromReader(cr, int64(v[1]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checksums: %s", err)
+	}
+
+	// skip the signature
+	_, err = io.Copy(io.Discard, cr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checksums: %s", err)
+	}
+
+	gcf := &GCF{Manifest: manifest, Index: make(Index), Checksums: checksums}
+
+	data := &extentReader{}
+	gcf.Data = data
+
+	if major == ncfMajorVersion {
+		err = gcf.addCommonFiles(data, commondir)
+		if err != nil {
+			return nil, err
+		}
+
+		return gcf, nil
+	}
+
+	// data blocks
+	headerSize := 6
+	if minor < 5 {
+		headerSize = 5
+	}
+
+	v, err = readUint32List(r, headerSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data block header: %s", err)
+	}
+
+	firstBlockOffset := int64(v[headerSize-3])
+
+	for n, i := range manifest.Items {
+		if i.IsDirectory() {
+			continue
+		}
+
+		// several items can share a file id
+		if _, ok := gcf.Index[int(i.ID)]; ok {
+			continue
+		}
+
+		var itemEntries []gcfBlockEntry
+		if directoryMap != nil {
+			for e := directoryMap[n]; e < blockCount; e = entries[e].next {
+				itemEntries = append(itemEntries, entries[e])
+
+				if len(itemEntries) > len(entries) {
+					return nil, fmt.Errorf("block entries for %s loop", i.Path)
+				}
+			}
+		} else {
+			for _, e := range entries {
+				if e.flags&0x8000 != 0 && e.item == uint32(n) {
+					itemEntries = append(itemEntries, e)
+				}
+			}
+		}
+
+		sort.Slice(itemEntries, func(a int, b int) bool {
+			return itemEntries[a].dataOffset < itemEntries[b].dataOffset
+		})
+
+		base := data.size
+
+		for _, e := range itemEntries {
+			remaining := int64(e.dataSize)
+
+			for b := e.firstBlock; remaining > 0; b = fragmentation[b] {
+				if b >= blockCount || b == terminator {
+					return nil, fmt.Errorf("data blocks for %s end early", i.Path)
+				}
+
+				length := min(remaining, int64(blockSize))
+
+				data.add(f, firstBlockOffset+int64(b)*int64(blockSize), length)
+
+				remaining -= length
+			}
+		}
+
+		file, err := gcfChunks(data, base, data.size-base, i.Type&itemEncrypted != 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", i.Path, err)
+		}
+
+		gcf.Index[int(i.ID)] = file
+	}
+
+	return gcf, nil
+}
+
+func (g *GCF) addCommonFiles(data *extentReader, commondir string) error {
+	for _, i := range g.Manifest.Items {
+		if i.IsDirectory() {
+			continue
+		}
+
+		if _, ok := g.Index[int(i.ID)]; ok {
+			continue
+		}
+
+		f := commonFile{name: path.Join(commondir, i.Path)}
+
+		base := data.size
+
+		data.add(f, 0, int64(i.Size))
+
+		file, err := gcfChunks(data, base, int64(i.Size), false)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %s", i.Path, err)
+		}
+
+		g.Index[int(i.ID)] = file
+	}
+
+	return nil
+}
+
+// splits a file's data up into chunks
+func gcfChunks(data io.ReaderAt, base int64, size int64, encrypted bool) (*File, error) {
+	var chunks []Chunk
+
+	if !encrypted {
+		for off := int64(0); off < size; off += gcfChunkSize {
+			chunks = append(chunks, Chunk{Offset: uint64(base + off), Length: uint64(min(gcfChunkSize, size-off))})
+		}
+
+		return &File{Chunks: chunks, Mode: Raw}, nil
+	}
+
+	// each chunk has a header with its compressed size, the encrypted data is padded
+	for off := int64(0); off < size; {
+		v, err := readUint32List(io.NewSectionReader(data, base+off, 8), 2)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk header: %s", err)
+		}
+
+		length := 8 + (int64(v[0])+0xF)&^0xF
+		if off+length > size {
+			return nil, fmt.Errorf("chunk at %d is too long", off)
+		}
+
+		chunks = append(chunks, Chunk{Offset: uint64(base + off), Length: uint64(length)})
+
+		off += length
+	}
+
+	return &File{Chunks: chunks, Mode: EncryptedCompressed}, nil
+}
+
+const gcfChunkSize = 0x8000
+
+type extent struct {
+	start  int64
+	src    io.ReaderAt
+	offset int64
+	length int64
+}
+
+// stitches pieces of other readers together
+type extentReader struct {
+	extents []extent
+	size    int64
+}
+
+func (r *extentReader) add(src io.ReaderAt, offset int64, length int64) {
+	// merge with the previous extent if it's contiguous
+	if len(r.extents) != 0 {
+		last := &r.extents[len(r.extents)-1]
+		if last.src == src && last.offset+last.length == offset {
+			last.length += length
+			r.size += length
+
+			return
+		}
+	}
+
+	r.extents = append(r.extents, extent{start: r.size, src: src, offset: offset, length: length})
+	r.size += length
+}
+
+func (r *extentReader) ReadAt(dst []byte, off int64) (int, error) {
+	var read int
+	for read < len(dst) {
+		pos := off + int64(read)
+		if pos >= r.size {
+			return read, io.EOF
+		}
+
+		i := sort.Search(len(r.extents), func(i int) bool { return r.extents[i].start+r.extents[i].length > pos })
+		e := r.extents[i]
+
+		end := min(len(dst), read+int(e.start+e.length-pos))
+
+		n, err := e.src.ReadAt(dst[read:end], e.offset+pos-e.start)
+		read += n
+		if err != nil && !(err == io.EOF && read == end) {
+			return read, err
+		}
+	}
+
+	return read, nil
+}
+
+// opened for each read and closed straight after, so an ncf with thousands of
+// files in its common folder never holds more than one open per read in flight
+type commonFile struct {
+	name string
+}
+
+func (f commonFile) ReadAt(dst []byte, off int64) (int, error) {
+	file, err := os.Open(f.name)
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	return file.ReadAt(dst, off)
+}
@@ -0,0 +1,352 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gozelle
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	gcfHeaderSize                 = 44
+	gcfBlockEntryHeaderSize       = 32
+	gcfBlockEntrySize             = 28
+	gcfFragmentationMapHeaderSize = 16
+	gcfDirectoryMapHeaderSize     = 8
+	gcfChecksumHeaderSize         = 8
+	gcfChecksumMapHeaderSize      = 16
+	gcfChecksumSignatureSize      = 0x80
+	gcfDataBlockHeaderSize        = 24
+
+	gcfVersion     = 6
+	gcfBlockSize   = 0x2000
+	gcfBlockUsed   = 0x200F8000
+	gcfTerminator  = 0xFFFFFFFF
+	gcfNoBlock     = 0xFFFFFFFF
+	gcfMaxFileSize = 0xFFFFFFFF
+)
+
+type gcfFile struct {
+	item      int
+	file      *File
+	size      uint64
+	encrypted bool
+
+	entry      uint32
+	firstBlock uint32
+	blocks     uint32
+}
+
+// keepEncryption stores EncryptedCompressed files as they are in the storage instead of decoding them
+func WriteGCF(w io.WriteSeeker, manifest Manifest, index Index, src io.ReaderAt, key []byte, keepEncryption bool) error {
+	checksumBlockSize := manifest.BlockSize
+	if checksumBlockSize == 0 {
+		return fmt.Errorf("manifest has no block size")
+	}
+
+	directory, err := manifest.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %s", err)
+	}
+
+	// lay out the files, each one gets a single block entry and a run of data blocks
+	var files []gcfFile
+	var blockCount, entryCount uint32
+
+	numIDs := 0
+	for n, i := range manifest.Items {
+		if i.IsDirectory() {
+			continue
+		}
+
+		file, ok := index[int(i.ID)]
+		if !ok {
+			return fmt.Errorf("file %s missing from index", i.Path)
+		}
+
+		f := gcfFile{item: n, file: file, size: uint64(i.Size), entry: gcfNoBlock}
+
+		if keepEncryption && file.Mode == EncryptedCompressed {
+			f.encrypted = true
+
+			f.size = 0
+			for _, c := range file.Chunks {
+				f.size += c.Length
+			}
+		}
+
+		if f.size > gcfMaxFileSize {
+			return fmt.Errorf("file %s is too big for a gcf", i.Path)
+		}
+
+		// the directory flags have to match what's actually stored
+		flags := i.Type &^ itemEncrypted
+		if f.encrypted {
+			flags |= itemEncrypted
+		}
+
+		binary.LittleEndian.PutUint32(directory[56+n*28+12:], flags)
+
+		f.blocks = uint32((f.size + gcfBlockSize - 1) / gcfBlockSize)
+		if f.blocks != 0 {
+			f.entry = entryCount
+			f.firstBlock = blockCount
+
+			entryCount++
+			blockCount += f.blocks
+		}
+
+		numIDs = max(numIDs, int(i.ID)+1)
+
+		files = append(files, f)
+	}
+
+	binary.LittleEndian.PutUint32(directory[52:], manifestChecksum(directory))
+
+	// checksum counts are known up front, the values are filled in once the data is written
+	checksumCounts := make([]uint32, numIDs)
+	for _, f := range files {
+		item := manifest.Items[f.item]
+		checksumCounts[item.ID] = uint32((uint64(item.Size) + uint64(checksumBlockSize) - 1) / uint64(checksumBlockSize))
+	}
+
+	var numChecksums uint32
+	for _, c := range checksumCounts {
+		numChecksums += c
+	}
+
+	checksumSize := gcfChecksumMapHeaderSize + uint64(numIDs)*8 + uint64(numChecksums)*4 + gcfChecksumSignatureSize
+
+	checksumOffset := uint64(gcfHeaderSize) +
+		gcfBlockEntryHeaderSize + uint64(blockCount)*gcfBlockEntrySize +
+		gcfFragmentationMapHeaderSize + uint64(blockCount)*4 +
+		uint64(len(directory)) +
+		gcfDirectoryMapHeaderSize + uint64(len(manifest.Items))*4 +
+		gcfChecksumHeaderSize + gcfChecksumMapHeaderSize + uint64(numIDs)*8
+
+	dataOffset := checksumOffset + uint64(numChecksums)*4 + gcfChecksumSignatureSize + gcfDataBlockHeaderSize
+
+	fileSize := dataOffset + uint64(blockCount)*gcfBlockSize
+	if fileSize > gcfMaxFileSize {
+		return fmt.Errorf("depot is too big for a gcf")
+	}
+
+	bw := bufio.NewWriterSize(w, 0x10000)
+
+	// header
+	header := []uint32{1, 1, gcfVersion, manifest.DepotID, manifest.DepotVersion, 0, 0, uint32(fileSize), gcfBlockSize, blockCount}
+
+	err = writeUint32List(bw, append(header, sumUint32List(header...))...)
+	if err != nil {
+		return fmt.Errorf("failed to write header: %s", err)
+	}
+
+	// block entries
+	header = []uint32{blockCount, entryCount, 0, 0, 0, 0, 0}
+
+	err = writeUint32List(bw, append(header, sumUint32List(header...))...)
+	if err != nil {
+		return fmt.Errorf("failed to write block entry header: %s", err)
+	}
+
+	for _, f := range files {
+		if f.blocks == 0 {
+			continue
+		}
+
+		err = writeUint32List(bw, gcfBlockUsed, 0, uint32(f.size), f.firstBlock, blockCount, blockCount, uint32(f.item))
+		if err != nil {
+			return fmt.Errorf("failed to write block entry: %s", err)
+		}
+	}
+
+	for range blockCount - entryCount {
+		err = writeUint32List(bw, 0, 0, 0, blockCount, blockCount, blockCount, 0)
+		if err != nil {
+			return fmt.Errorf("failed to write block entry: %s", err)
+		}
+	}
+
+	// fragmentation map, every file's blocks are contiguous
+	header = []uint32{blockCount, blockCount, 1}
+
+	err = writeUint32List(bw, append(header, sumUint32List(header...))...)
+	if err != nil {
+		return fmt.Errorf("failed to write fragmentation map header: %s", err)
+	}
+
+	for _, f := range files {
+		for b := range f.blocks {
+			next := f.firstBlock + b + 1
+			if b == f.blocks-1 {
+				next = gcfTerminator
+			}
+
+			err = writeUint32List(bw, next)
+			if err != nil {
+				return fmt.Errorf("failed to write fragmentation map: %s", err)
+			}
+		}
+	}
+
+	// directory
+	_, err = bw.Write(directory)
+	if err != nil {
+		return fmt.Errorf("failed to write directory: %s", err)
+	}
+
+	// directory map
+	entries := make([]uint32, len(manifest.Items))
+	for i := range entries {
+		entries[i] = blockCount
+	}
+
+	for _, f := range files {
+		if f.blocks != 0 {
+			entries[f.item] = f.entry
+		}
+	}
+
+	err = writeUint32List(bw, append([]uint32{1, 0}, entries...)...)
+	if err != nil {
+		return fmt.Errorf("failed to write directory map: %s", err)
+	}
+
+	// checksums
+	err = writeUint32List(bw, 1, uint32(checksumSize), checksumFormatCode, 1, uint32(numIDs), numChecksums)
+	if err != nil {
+		return fmt.Errorf("failed to write checksum header: %s", err)
+	}
+
+	var first uint32
+	for _, c := range checksumCounts {
+		err = writeUint32List(bw, c, first)
+		if err != nil {
+			return fmt.Errorf("failed to write checksum map: %s", err)
+		}
+
+		first += c
+	}
+
+	// placeholder checksums and an empty signature
+	_, err = bw.Write(make([]byte, uint64(numChecksums)*4+gcfChecksumSignatureSize))
+	if err != nil {
+		return fmt.Errorf("failed to write checksums: %s", err)
+	}
+
+	// data
+	header = []uint32{manifest.DepotVersion, blockCount, gcfBlockSize, uint32(dataOffset), blockCount}
+
+	err = writeUint32List(bw, append(header, sumUint32List(header...))...)
+	if err != nil {
+		return fmt.Errorf("failed to write data block header: %s", err)
+	}
+
+	checksums := make([][]uint32, numIDs)
+
+	for _, f := range files {
+		item := manifest.Items[f.item]
+
+		sums, err := writeGCFFile(bw, f, src, key, checksumBlockSize)
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %s", item.Path, err)
+		}
+
+		if uint32(len(sums)) != checksumCounts[item.ID] {
+			return fmt.Errorf("failed to write %s: expected %d checksums, got %d", item.Path, checksumCounts[item.ID], len(sums))
+		}
+
+		checksums[item.ID] = sums
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write data: %s", err)
+	}
+
+	// go back and fill in the checksums
+	_, err = w.Seek(int64(checksumOffset), io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("failed to seek to checksums: %s", err)
+	}
+
+	for id, sums := range checksums {
+		if sums == nil {
+			sums = make([]uint32, checksumCounts[id])
+		}
+
+		err = writeUint32List(bw, sums...)
+		if err != nil {
+			return fmt.Errorf("failed to write checksums: %s", err)
+		}
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write checksums: %s", err)
+	}
+
+	_, err = w.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to seek to end: %s", err)
+	}
+
+	return nil
+}
+
+// writes a file's data blocks and returns the checksums of its decoded data
+func writeGCFFile(w io.Writer, f gcfFile, src io.ReaderAt, key []byte, checksumBlockSize uint32) ([]uint32, error) {
+	cw := newChecksumWriter(checksumBlockSize)
+
+	r := f.file.NewReader(key, src, DefaultBufferSize)
+	defer r.Close()
+
+	var dst io.Writer = io.MultiWriter(w, cw)
+	if f.encrypted {
+		dst = cw
+	}
+
+	n, err := io.Copy(dst, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode file: %s", err)
+	}
+
+	if !f.encrypted && uint64(n) != f.size {
+		return nil, fmt.Errorf("size mismatch, expected %d bytes, got %d", f.size, n)
+	}
+
+	// encrypted chunks are copied as they are
+	if f.encrypted {
+		for _, c := range f.file.Chunks {
+			_, err := io.Copy(w, io.NewSectionReader(src, int64(c.Offset), int64(c.Length)))
+			if err != nil {
+				return nil, fmt.Errorf("failed to copy chunk: %s", err)
+			}
+		}
+	}
+
+	// pad out the last block
+	_, err = w.Write(make([]byte, uint64(f.blocks)*gcfBlockSize-f.size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to write padding: %s", err)
+	}
+
+	return cw.Sum(), nil
+}
@@ -27,7 +27,7 @@ func readUint32List(r io.Reader, num int) ([]uint32, error) {
 
 	for i := range num {
 		b := make([]byte, 4)
-		_, err := r.Read(b)
+		_, err := io.ReadFull(r, b)
 		if err != nil {
 			return nil, err
 		}
@@ -43,7 +43,7 @@ func readUint64List(r io.Reader, num int) ([]uint64, error) {
 
 	for i := range num {
 		b := make([]byte, 8)
-		_, err := r.Read(b)
+		_, err := io.ReadFull(r, b)
 		if err != nil {
 			return nil, err
 		}
@@ -53,3 +53,106 @@ func readUint64List(r io.Reader, num int) ([]uint64, error) {
 
 	return out, nil
 }
+
+func adler32(seed uint32, data []byte) uint32 {
+	a, b := seed&0xFFFF, seed>>16
+
+	for _, v := range data {
+		a = (a + uint32(v)) % 65521
+		b = (b + a) % 65521
+	}
+
+	return b<<16 | a
+}
+
+func writeUint32List(w io.Writer, values ...uint32) error {
+	b := make([]byte, 4*len(values))
+
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(b[i*4:], v)
+	}
+
+	_, err := w.Write(b)
+
+	return err
+}
+
+// used as a checksum by some headers
+func sumUint32List(values ...uint32) uint32 {
+	var sum uint32
+	for _, v := range values {
+		sum += v
+	}
+
+	return sum
+}
+
+func writeUint64List(w io.Writer, values ...uint64) error {
+	b := make([]byte, 8*len(values))
+
+	for i, v := range values {
+		binary.BigEndian.PutUint64(b[i*8:], v)
+	}
+
+	_, err := w.Write(b)
+
+	return err
+}
+
+// bob jenkins' lookup2
+func lookup2(k []byte, initval uint32) uint32 {
+	a, b, c := uint32(0x9e3779b9), uint32(0x9e3779b9), initval
+
+	mix := func() {
+		a -= b
+		a -= c
+		a ^= c >> 13
+		b -= c
+		b -= a
+		b ^= a << 8
+		c -= a
+		c -= b
+		c ^= b >> 13
+		a -= b
+		a -= c
+		a ^= c >> 12
+		b -= c
+		b -= a
+		b ^= a << 16
+		c -= a
+		c -= b
+		c ^= b >> 5
+		a -= b
+		a -= c
+		a ^= c >> 3
+		b -= c
+		b -= a
+		b ^= a << 10
+		c -= a
+		c -= b
+		c ^= b >> 15
+	}
+
+	length := uint32(len(k))
+
+	for len(k) >= 12 {
+		a += binary.LittleEndian.Uint32(k[0:])
+		b += binary.LittleEndian.Uint32(k[4:])
+		c += binary.LittleEndian.Uint32(k[8:])
+		mix()
+		k = k[12:]
+	}
+
+	c += length
+
+	// the lowest byte of c is reserved for the length
+	var tail [12]byte
+	copy(tail[:], k)
+
+	c += uint32(tail[8])<<8 | uint32(tail[9])<<16 | uint32(tail[10])<<24
+	b += binary.LittleEndian.Uint32(tail[4:])
+	a += binary.LittleEndian.Uint32(tail[0:])
+	mix()
+
+	return c
+}
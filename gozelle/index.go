@@ -34,9 +34,46 @@ const (
 	Encrypted
 )
 
+var modeNames = []string{"raw", "compressed", "encryptedcompressed", "encrypted"}
+
+func (m Mode) String() string {
+	if m < 0 || int(m) >= len(modeNames) {
+		return fmt.Sprintf("unknown (%d)", int(m))
+	}
+
+	return modeNames[m]
+}
+
+func ParseMode(s string) (Mode, error) {
+	for i, name := range modeNames {
+		if s == name {
+			return Mode(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown mode %s", s)
+}
+
 type Index map[int]*File
 
+// where the last chunk in the index ends
+func (idx Index) End() uint64 {
+	var end uint64
+	for _, file := range idx {
+		for _, c := range file.Chunks {
+			end = max(end, c.Offset+c.Length)
+		}
+	}
+
+	return end
+}
+
 func IndexFromFile(storagedir string, depot int) (Index, error) {
+	err := checkStorage(storagedir, depot)
+	if err != nil {
+		return nil, err
+	}
+
 	file, err := os.Open(path.Join(storagedir, fmt.Sprintf("%d.index", depot)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open index file: %s", err)
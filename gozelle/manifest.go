@@ -18,6 +18,9 @@
 package gozelle
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -45,6 +48,12 @@ type Manifest struct {
 	Dummy3       uint32 `json:"dummy3"`
 	Checksum     uint32 `json:"checksum"`
 	Items        []Item `json:"items"`
+
+	// trailing sections, kept so manifests can be written back unchanged
+	HashTableKeys     []uint32 `json:"hashTableKeys"`
+	HashTableIndices  []uint32 `json:"hashTableIndices"`
+	MinimumFootprints []uint32 `json:"minimumFootprints"`
+	UserConfigs       []uint32 `json:"userConfigs"`
 }
 
 type Item struct {
@@ -58,26 +67,216 @@ type Item struct {
 	Path        string `json:"path"`
 }
 
+const (
+	itemEncrypted = 0x100
+	itemFile      = 0x4000
+)
+
 func (i Item) IsDirectory() bool {
-	return i.Type&0x4000 == 0
+	return i.Type&itemFile == 0
 }
 
-func ManifestFromFile(manifestdir string, depot int, version int) (Manifest, error) {
-	file, err := os.Open(path.Join(manifestdir, fmt.Sprintf("%d_%d.manifest", depot, version)))
+var ErrManifestChecksum = errors.New("manifest checksum mismatch")
+
+func ManifestFromFile(manifestdir string, depot int, version int, verify bool) (Manifest, error) {
+	data, err := os.ReadFile(path.Join(manifestdir, fmt.Sprintf("%d_%d.manifest", depot, version)))
 	if err != nil {
 		return Manifest{}, fmt.Errorf("failed to open manifest file: %s", err)
 	}
 
-	defer file.Close()
-
-	manifest, err := manifestFromReader(file)
+	manifest, err := manifestFromReader(bytes.NewReader(data))
 	if err != nil {
 		return manifest, fmt.Errorf("failed to read manifest: %s", err)
 	}
 
+	if !verify {
+		return manifest, nil
+	}
+
+	// the manifest is still returned so callers can choose to ignore this
+	if uint32(len(data)) < manifest.DirSize {
+		return manifest, fmt.Errorf("%w: manifest is truncated, expected %d bytes, got %d", ErrManifestChecksum, manifest.DirSize, len(data))
+	}
+
+	checksum := manifestChecksum(data[:manifest.DirSize])
+	if checksum != manifest.Checksum {
+		return manifest, fmt.Errorf("%w: expected %#08x, got %#08x", ErrManifestChecksum, manifest.Checksum, checksum)
+	}
+
 	return manifest, nil
 }
 
+func ManifestToFile(manifestdir string, manifest Manifest) error {
+	data, err := manifest.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %s", err)
+	}
+
+	err = os.WriteFile(path.Join(manifestdir, fmt.Sprintf("%d_%d.manifest", manifest.DepotID, manifest.DepotVersion)), data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write manifest file: %s", err)
+	}
+
+	return nil
+}
+
+// the header counts, sizes and checksum come from the items, a missing hash table is rebuilt from the item
+// names and one that doesn't cover exactly the items is rejected
+func (m Manifest) MarshalBinary() ([]byte, error) {
+	var names bytes.Buffer
+
+	nameOffsets := make([]uint32, len(m.Items))
+	for n, i := range m.Items {
+		nameOffsets[n] = uint32(names.Len())
+
+		names.WriteString(i.Name)
+		names.WriteByte(0x00)
+	}
+
+	keys, indices := m.HashTableKeys, m.HashTableIndices
+	if keys == nil {
+		keys, indices = hashTable(m.Items)
+	}
+
+	err := checkHashTable(keys, indices, len(m.Items))
+	if err != nil {
+		return nil, fmt.Errorf("stale hash table, leave it out to have it rebuilt: %s", err)
+	}
+
+	var numFiles uint32
+	for _, i := range m.Items {
+		if !i.IsDirectory() {
+			numFiles++
+		}
+	}
+
+	m.NumItems = uint32(len(m.Items))
+	m.NumFiles = numFiles
+	m.DirNameSize = uint32(names.Len())
+	m.InfoCount = uint32(len(keys))
+	m.CopyCount = uint32(len(m.MinimumFootprints))
+	m.LocalCount = uint32(len(m.UserConfigs))
+	m.DirSize = 56 + m.NumItems*28 + m.DirNameSize + m.InfoCount*4 + m.NumItems*4 + m.CopyCount*4 + m.LocalCount*4
+
+	var buf bytes.Buffer
+
+	writeUint32List(&buf, m.Dummy1, m.DepotID, m.DepotVersion, m.NumItems, m.NumFiles, m.BlockSize, m.DirSize, m.DirNameSize, m.InfoCount, m.CopyCount, m.LocalCount, m.Dummy2, m.Dummy3, 0)
+
+	for n, i := range m.Items {
+		writeUint32List(&buf, nameOffsets[n], i.Size, i.ID, i.Type, i.ParentIndex, i.NextIndex, i.FirstIndex)
+	}
+
+	buf.Write(names.Bytes())
+
+	writeUint32List(&buf, keys...)
+	writeUint32List(&buf, indices...)
+	writeUint32List(&buf, m.MinimumFootprints...)
+	writeUint32List(&buf, m.UserConfigs...)
+
+	data := buf.Bytes()
+
+	binary.LittleEndian.PutUint32(data[52:], manifestChecksum(data))
+
+	return data, nil
+}
+
+func (m *Manifest) UnmarshalBinary(data []byte) error {
+	manifest, err := manifestFromReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	*m = manifest
+
+	return nil
+}
+
+// lets the client look items up by name, the end of each bucket is marked with the high bit
+func hashTable(items []Item) ([]uint32, []uint32) {
+	count := 1
+	for count < len(items) {
+		count *= 2
+	}
+
+	buckets := make([][]uint32, count)
+	for n, i := range items {
+		h := lookup2([]byte(strings.ToLower(i.Name)), 1) & uint32(count-1)
+
+		buckets[h] = append(buckets[h], uint32(n))
+	}
+
+	keys := make([]uint32, count)
+	indices := make([]uint32, 0, len(items))
+
+	for h, b := range buckets {
+		if b == nil {
+			keys[h] = 0xFFFFFFFF
+			continue
+		}
+
+		keys[h] = uint32(len(indices))
+
+		b[len(b)-1] |= 0x80000000
+		indices = append(indices, b...)
+	}
+
+	return keys, indices
+}
+
+// every item has to be in exactly one bucket
+func checkHashTable(keys []uint32, indices []uint32, items int) error {
+	if len(indices) != items {
+		return fmt.Errorf("%d indices for %d items", len(indices), items)
+	}
+
+	seen := make([]bool, items)
+	for h, k := range keys {
+		if k == 0xFFFFFFFF {
+			continue
+		}
+
+		for j := int(k); ; j++ {
+			if j >= len(indices) {
+				return fmt.Errorf("bucket %d runs past the end of the indices", h)
+			}
+
+			n := indices[j] &^ 0x80000000
+			if int(n) >= items {
+				return fmt.Errorf("bucket %d points at item %d of %d", h, n, items)
+			}
+
+			if seen[n] {
+				return fmt.Errorf("item %d is in more than one bucket", n)
+			}
+
+			seen[n] = true
+
+			if indices[j]&0x80000000 != 0 {
+				break
+			}
+		}
+	}
+
+	if i := slices.Index(seen, false); i != -1 {
+		return fmt.Errorf("item %d isn't in any bucket", i)
+	}
+
+	return nil
+}
+
+// adler32 of the manifest with the fingerprint and checksum fields zeroed
+func manifestChecksum(data []byte) uint32 {
+	if len(data) < 56 {
+		return adler32(0, data)
+	}
+
+	checksum := adler32(0, data[:48])
+	checksum = adler32(checksum, make([]byte, 8))
+	checksum = adler32(checksum, data[56:])
+
+	return checksum
+}
+
 func manifestFromReader(r io.ReadSeeker) (Manifest, error) {
 	var manifest Manifest
 
@@ -166,5 +365,50 @@ func manifestFromReader(r io.ReadSeeker) (Manifest, error) {
 		manifest.Items[i].Path = path.Join(hierarchy...)
 	}
 
+	_, err = r.Seek(int64(56+(manifest.NumItems*28)+manifest.DirNameSize), 0)
+	if err != nil {
+		return manifest, fmt.Errorf("failed to seek to hash table: %s", err)
+	}
+
+	// the trailing sections are optional so a truncated manifest still loads, the
+	// checksum check is what reports it, and a missing hash table gets rebuilt
+	truncated := func(err error) bool {
+		return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+
+	keys, err := readUint32List(r, int(manifest.InfoCount))
+	if truncated(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read hash table: %s", err)
+	}
+
+	indices, err := readUint32List(r, int(manifest.NumItems))
+	if truncated(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read hash table: %s", err)
+	}
+
+	manifest.HashTableKeys, manifest.HashTableIndices = keys, indices
+
+	manifest.MinimumFootprints, err = readUint32List(r, int(manifest.CopyCount))
+	if truncated(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read minimum footprint entries: %s", err)
+	}
+
+	manifest.UserConfigs, err = readUint32List(r, int(manifest.LocalCount))
+	if truncated(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read user config entries: %s", err)
+	}
+
 	return manifest, nil
 }
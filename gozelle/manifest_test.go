@@ -0,0 +1,239 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gozelle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"testing"
+)
+
+// laid out by hand rather than by MarshalBinary, with a hash table that has more
+// buckets than hashTable would use, so only a byte-for-byte copy round trips
+func handmadeManifest() []byte {
+	const none = 0xFFFFFFFF
+
+	var b []byte
+	put := func(values ...uint32) {
+		for _, v := range values {
+			b = binary.LittleEndian.AppendUint32(b, v)
+		}
+	}
+
+	// dummy1, depot, version, items, files, block size, dir size, name size,
+	// hash buckets, footprints, user configs, dummy2, dummy3, checksum
+	put(4, 5, 3, 3, 1, 0x8000, 203, 11, 8, 1, 1, 0, 0, 0x1eaa2a14)
+
+	// name offset, size, id, type, parent, next, first
+	put(0, 1, none, 0, none, 0, 1)
+	put(1, 1, none, 0, 0, 0, 2)
+	put(5, 100, 0, itemFile, 1, 0, 0)
+
+	b = append(b, "\x00bin\x00a.exe\x00"...)
+
+	// hash table keys and indices, the root and bin share a bucket
+	put(none, 0, none, none, 2, none, none, none)
+	put(0, 0x80000001, 0x80000002)
+
+	// minimum footprints and user configs
+	put(2)
+	put(7)
+
+	return b
+}
+
+// a packed manifest with trailing sections that aren't rebuilt
+func testManifest(t *testing.T) []byte {
+	t.Helper()
+
+	manifest, _, _, _ := testPack(t, testTree(), Compressed)
+	manifest.MinimumFootprints = []uint32{1, 2}
+	manifest.UserConfigs = []uint32{3}
+
+	data, err := manifest.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to encode manifest: %s", err)
+	}
+
+	return data
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	data := testManifest(t)
+
+	var manifest Manifest
+	err := manifest.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("failed to decode manifest: %s", err)
+	}
+
+	if manifest.Checksum != manifestChecksum(data) {
+		t.Fatalf("got checksum %08x, want %08x", manifest.Checksum, manifestChecksum(data))
+	}
+
+	out, err := manifest.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to encode manifest: %s", err)
+	}
+
+	if !bytes.Equal(out, data) {
+		t.Fatalf("binary round trip changed the manifest")
+	}
+
+	// and through json, like manifest -json and manifest -fromjson
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("failed to encode json: %s", err)
+	}
+
+	var decoded Manifest
+	err = json.Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatalf("failed to decode json: %s", err)
+	}
+
+	out, err = decoded.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to encode manifest: %s", err)
+	}
+
+	if !bytes.Equal(out, data) {
+		t.Fatalf("json round trip changed the manifest")
+	}
+}
+
+func TestManifestHashTable(t *testing.T) {
+	var manifest Manifest
+	err := manifest.UnmarshalBinary(testManifest(t))
+	if err != nil {
+		t.Fatalf("failed to decode manifest: %s", err)
+	}
+
+	// an item added without touching the hash table
+	stale := manifest
+	stale.Items = append(stale.Items[:len(stale.Items):len(stale.Items)], Item{Name: "new.txt", ParentIndex: 0, ID: 100, Type: itemFile})
+
+	_, err = stale.MarshalBinary()
+	if err == nil {
+		t.Fatalf("encoded a manifest with a stale hash table")
+	}
+
+	// leaving it out gets it rebuilt
+	stale.HashTableKeys, stale.HashTableIndices = nil, nil
+
+	data, err := stale.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to encode manifest: %s", err)
+	}
+
+	var rebuilt Manifest
+	err = rebuilt.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("failed to decode manifest: %s", err)
+	}
+
+	err = checkHashTable(rebuilt.HashTableKeys, rebuilt.HashTableIndices, len(rebuilt.Items))
+	if err != nil {
+		t.Fatalf("rebuilt hash table is broken: %s", err)
+	}
+
+	// items in two buckets, in none, or a bucket that never ends
+	for _, table := range [][2][]uint32{
+		{{0, 1}, {0, 0x80000000}},
+		{{0, 0xFFFFFFFF}, {0x80000000, 0x80000001}},
+		{{0, 0xFFFFFFFF}, {0, 1}},
+	} {
+		err := checkHashTable(table[0], table[1], 2)
+		if err == nil {
+			t.Fatalf("accepted hash table %x", table)
+		}
+	}
+}
+
+func TestManifestHandmade(t *testing.T) {
+	data := handmadeManifest()
+
+	var manifest Manifest
+	err := manifest.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("failed to decode manifest: %s", err)
+	}
+
+	if got := manifestChecksum(data); got != manifest.Checksum || got != 0x1eaa2a14 {
+		t.Fatalf("got checksum %08x, header says %08x", got, manifest.Checksum)
+	}
+
+	var paths []string
+	for _, i := range manifest.Items {
+		paths = append(paths, i.Path)
+	}
+
+	if !slices.Equal(paths, []string{"", "bin", "bin/a.exe"}) || manifest.Items[2].Size != 100 || manifest.Items[2].IsDirectory() {
+		t.Fatalf("unexpected items %+v", manifest.Items)
+	}
+
+	if len(manifest.HashTableKeys) != 8 || !slices.Equal(manifest.MinimumFootprints, []uint32{2}) || !slices.Equal(manifest.UserConfigs, []uint32{7}) {
+		t.Fatalf("unexpected trailing sections %+v", manifest)
+	}
+
+	out, err := manifest.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to encode manifest: %s", err)
+	}
+
+	if !bytes.Equal(out, data) {
+		t.Fatalf("round trip changed the manifest:\n got %x\nwant %x", out, data)
+	}
+}
+
+func TestManifestTruncated(t *testing.T) {
+	dir := t.TempDir()
+
+	// cut off right after the names
+	data := handmadeManifest()[:56+3*28+11]
+
+	err := os.WriteFile(path.Join(dir, "5_3.manifest"), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := ManifestFromFile(dir, 5, 3, false)
+	if err != nil {
+		t.Fatalf("failed to read truncated manifest: %s", err)
+	}
+
+	if len(manifest.Items) != 3 || manifest.HashTableKeys != nil {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+
+	manifest, err = ManifestFromFile(dir, 5, 3, true)
+	if !errors.Is(err, ErrManifestChecksum) || len(manifest.Items) != 3 {
+		t.Fatalf("got error %v with %d items, want a checksum error with the manifest", err, len(manifest.Items))
+	}
+
+	// and it can still be written back out with a rebuilt hash table
+	_, err = manifest.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to encode manifest: %s", err)
+	}
+}
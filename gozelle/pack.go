@@ -0,0 +1,195 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gozelle
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+)
+
+type PackOptions struct {
+	DepotID      uint32
+	DepotVersion uint32
+	BlockSize    uint32
+	Mode         Mode
+	Key          []byte
+	Level        int
+
+	// ids are handed out from here so existing files in the storage aren't clobbered
+	FirstID int
+}
+
+// builds a manifest from a directory tree, writing each file's chunks to the storage
+func Pack(fsys fs.FS, storage *StorageWriter, opts PackOptions) (Manifest, Checksums, error) {
+	if opts.BlockSize == 0 {
+		return Manifest{}, nil, fmt.Errorf("invalid block size")
+	}
+
+	if (opts.Mode == EncryptedCompressed || opts.Mode == Encrypted) && opts.Key == nil {
+		return Manifest{}, nil, fmt.Errorf("missing encryption key")
+	}
+
+	manifest := Manifest{
+		Dummy1:       4,
+		DepotID:      opts.DepotID,
+		DepotVersion: opts.DepotVersion,
+		BlockSize:    opts.BlockSize,
+	}
+
+	checksums := make(Checksums)
+
+	parents := map[string]int{".": 0}
+	lastChild := make(map[int]int)
+
+	id := opts.FirstID
+
+	// parents always come before their children since the walk is depth first
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if name == "." {
+			manifest.Items = append(manifest.Items, Item{ParentIndex: 0xFFFFFFFF, ID: 0xFFFFFFFF})
+			return nil
+		}
+
+		parent := parents[path.Dir(name)]
+		n := len(manifest.Items)
+
+		item := Item{
+			Name:        d.Name(),
+			Path:        name,
+			ParentIndex: uint32(parent),
+			ID:          0xFFFFFFFF,
+		}
+
+		if d.IsDir() {
+			parents[name] = n
+		} else {
+			if !d.Type().IsRegular() {
+				return fmt.Errorf("%s is not a regular file", name)
+			}
+
+			item.Type = itemFile
+			if opts.Mode == EncryptedCompressed || opts.Mode == Encrypted {
+				item.Type |= itemEncrypted
+			}
+
+			item.ID = uint32(id)
+
+			size, list, err := packFile(fsys, name, storage, id, opts)
+			if err != nil {
+				return err
+			}
+
+			item.Size = size
+			checksums[id] = list
+
+			id++
+		}
+
+		// link into the parent's list of children
+		if prev, ok := lastChild[parent]; ok {
+			manifest.Items[prev].NextIndex = uint32(n)
+		} else {
+			manifest.Items[parent].FirstIndex = uint32(n)
+		}
+
+		lastChild[parent] = n
+
+		// directories store how many children they have
+		manifest.Items[parent].Size++
+
+		manifest.Items = append(manifest.Items, item)
+
+		return nil
+	})
+	if err != nil {
+		return Manifest{}, nil, err
+	}
+
+	// fill in the header and hash table
+	data, err := manifest.MarshalBinary()
+	if err != nil {
+		return Manifest{}, nil, fmt.Errorf("failed to encode manifest: %s", err)
+	}
+
+	err = manifest.UnmarshalBinary(data)
+	if err != nil {
+		return Manifest{}, nil, fmt.Errorf("failed to read back manifest: %s", err)
+	}
+
+	return manifest, checksums, nil
+}
+
+func packFile(fsys fs.FS, name string, storage *StorageWriter, id int, opts PackOptions) (uint32, []uint32, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to open %s: %s", name, err)
+	}
+
+	defer f.Close()
+
+	file := &File{Mode: opts.Mode}
+
+	var size uint64
+	var list []uint32
+
+	block := make([]byte, opts.BlockSize)
+	for {
+		n, err := io.ReadFull(f, block)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, nil, fmt.Errorf("failed to read %s: %s", name, err)
+		}
+
+		encoded, err := EncodeChunk(block[:n], opts.Key, opts.Mode, opts.Level)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to encode %s: %s", name, err)
+		}
+
+		chunk, err := storage.WriteChunk(encoded)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		file.Chunks = append(file.Chunks, chunk)
+		list = append(list, Checksum(block[:n]))
+		size += uint64(n)
+
+		if n < len(block) {
+			break
+		}
+	}
+
+	if size > 0xFFFFFFFF {
+		return 0, nil, fmt.Errorf("%s is too big", name)
+	}
+
+	err = storage.WriteFile(id, file)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return uint32(size), list, nil
+}
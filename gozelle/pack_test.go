@@ -0,0 +1,103 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gozelle
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestPackRoundTrip(t *testing.T) {
+	for _, mode := range []Mode{Raw, Compressed, EncryptedCompressed, Encrypted} {
+		t.Run(mode.String(), func(t *testing.T) {
+			tree := testTree()
+			manifest, index, data, checksums := testPack(t, tree, mode)
+
+			// every file gets an id, the index and the checksums
+			for _, i := range manifest.Items {
+				if i.IsDirectory() {
+					continue
+				}
+
+				file, ok := index[int(i.ID)]
+				if !ok {
+					t.Fatalf("%s: missing from index", i.Path)
+				}
+
+				if file.Mode != mode {
+					t.Fatalf("%s: got mode %s, want %s", i.Path, file.Mode, mode)
+				}
+
+				blocks := (int(i.Size) + testBlockSize - 1) / testBlockSize
+				if len(file.Chunks) != blocks || len(checksums[int(i.ID)]) != blocks {
+					t.Fatalf("%s: got %d chunks and %d checksums, want %d", i.Path, len(file.Chunks), len(checksums[int(i.ID)]), blocks)
+				}
+
+				for _, c := range file.Chunks {
+					if c.Offset+c.Length > uint64(data.Len()) {
+						t.Fatalf("%s: chunk at %#x runs past the end of the data", i.Path, c.Offset)
+					}
+				}
+
+				err := checksums.Verify(int(i.ID), bytes.NewReader(tree[i.Path].Data), manifest.BlockSize)
+				if err != nil {
+					t.Fatalf("%s: %s", i.Path, err)
+				}
+			}
+
+			if len(index) != len(checksums) {
+				t.Fatalf("got %d index entries and %d checksum lists", len(index), len(checksums))
+			}
+
+			testCompareTree(t, NewFS(manifest, index, data, testKey), tree)
+
+			// the manifest survives being written out and read back
+			encoded, err := manifest.MarshalBinary()
+			if err != nil {
+				t.Fatalf("failed to encode manifest: %s", err)
+			}
+
+			var decoded Manifest
+			err = decoded.UnmarshalBinary(encoded)
+			if err != nil {
+				t.Fatalf("failed to decode manifest: %s", err)
+			}
+
+			testCompareTree(t, NewFS(decoded, index, data, testKey), tree)
+
+			// and so do the checksums
+			var buf bytes.Buffer
+			err = checksumsToWriter(&buf, checksums)
+			if err != nil {
+				t.Fatalf("failed to write checksums: %s", err)
+			}
+
+			read, err := checksumsFromReader(&buf, int64(buf.Len()))
+			if err != nil {
+				t.Fatalf("failed to read checksums: %s", err)
+			}
+
+			for id, list := range checksums {
+				if !slices.Equal(read[id], list) {
+					t.Fatalf("file %d: got checksums %x, want %x", id, read[id], list)
+				}
+			}
+		})
+	}
+}
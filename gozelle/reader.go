@@ -0,0 +1,358 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gozelle
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+var (
+	ErrInvalidSeek = errors.New("invalid seek position")
+	ErrChunkSize   = errors.New("chunk size mismatch")
+)
+
+// random access to a file, only the chunk containing the position is decoded
+type FileReader struct {
+	file      *File
+	key       []byte
+	src       io.ReaderAt
+	blockSize uint32
+	size      int64
+
+	pos int64
+
+	current    io.ReadCloser
+	currentPos int64
+}
+
+// blockSize and size come from the manifest, size can be -1 if it isn't known
+func (f *File) NewReadSeeker(key []byte, src io.ReaderAt, blockSize uint32, size int64) *FileReader {
+	return &FileReader{file: f, key: key, src: src, blockSize: blockSize, size: size}
+}
+
+func (r *FileReader) Size() (int64, error) {
+	offsets, err := r.file.chunkOffsets(r.key, r.src, r.blockSize, r.size)
+	if err != nil {
+		return 0, err
+	}
+
+	return offsets[len(offsets)-1], nil
+}
+
+func (r *FileReader) Read(dst []byte) (int, error) {
+	offsets, err := r.file.chunkOffsets(r.key, r.src, r.blockSize, r.size)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		// the open chunk is read to its end so anything left over is caught
+		if r.current == nil || r.currentPos != r.pos {
+			if r.pos >= offsets[len(offsets)-1] {
+				return 0, io.EOF
+			}
+
+			err := r.open(offsets)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.current.Read(dst)
+		r.pos += int64(n)
+		r.currentPos += int64(n)
+
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+// opens the chunk containing the current position
+func (r *FileReader) open(offsets []int64) error {
+	if r.current != nil {
+		r.current.Close()
+		r.current = nil
+	}
+
+	chunk, err := r.file.openChunkAt(r.key, r.src, offsets, r.pos)
+	if err != nil {
+		return err
+	}
+
+	r.current = chunk.reader
+	r.currentPos = r.pos
+
+	return nil
+}
+
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		size, err := r.Size()
+		if err != nil {
+			return 0, err
+		}
+
+		offset += size
+	default:
+		return 0, fmt.Errorf("unknown whence %d", whence)
+	}
+
+	if offset < 0 {
+		return 0, ErrInvalidSeek
+	}
+
+	r.pos = offset
+
+	return offset, nil
+}
+
+func (r *FileReader) ReadAt(dst []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrInvalidSeek
+	}
+
+	offsets, err := r.file.chunkOffsets(r.key, r.src, r.blockSize, r.size)
+	if err != nil {
+		return 0, err
+	}
+
+	var read int
+	for read < len(dst) {
+		if off+int64(read) >= offsets[len(offsets)-1] {
+			return read, io.EOF
+		}
+
+		chunk, err := r.file.openChunkAt(r.key, r.src, offsets, off+int64(read))
+		if err != nil {
+			return read, err
+		}
+
+		n, err := io.ReadFull(chunk.reader, dst[read:min(len(dst), read+int(offsets[chunk.index+1]-off-int64(read)))])
+		read += n
+
+		// reading up to the end of the chunk checks nothing is left over
+		if err == nil && off+int64(read) == offsets[chunk.index+1] {
+			_, err = chunk.reader.Read(nil)
+			if err == io.EOF {
+				err = nil
+			}
+		}
+
+		chunk.reader.Close()
+
+		if err != nil {
+			return read, fmt.Errorf("failed to read chunk %d: %w", chunk.index, err)
+		}
+	}
+
+	return read, nil
+}
+
+func (r *FileReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+
+	err := r.current.Close()
+	r.current = nil
+
+	return err
+}
+
+type openChunk struct {
+	index  int
+	reader io.ReadCloser
+}
+
+// decodes up to pos in the chunk containing it
+func (f *File) openChunkAt(key []byte, src io.ReaderAt, offsets []int64, pos int64) (openChunk, error) {
+	// last chunk starting at or before pos, skipping empty ones
+	i := sort.Search(len(offsets)-1, func(i int) bool { return offsets[i+1] > pos })
+	if i == len(offsets)-1 {
+		return openChunk{}, io.EOF
+	}
+
+	reader, err := f.Chunks[i].NewReader(key, src, f.Mode, DefaultBufferSize)
+	if err != nil {
+		return openChunk{}, fmt.Errorf("failed to open chunk %d: %s", i, err)
+	}
+
+	_, err = io.CopyN(io.Discard, reader, pos-offsets[i])
+	if err != nil {
+		reader.Close()
+		return openChunk{}, fmt.Errorf("failed to skip to position in chunk %d: %s", i, err)
+	}
+
+	return openChunk{index: i, reader: &chunkReader{ReadCloser: reader, index: i, remaining: offsets[i+1] - pos}}, nil
+}
+
+// stops at the expected end of a chunk, anything decoded past it means the offsets are wrong
+type chunkReader struct {
+	io.ReadCloser
+
+	index     int
+	remaining int64
+}
+
+func (c *chunkReader) Read(dst []byte) (int, error) {
+	if c.remaining <= 0 {
+		var b [1]byte
+
+		n, err := io.ReadAtLeast(c.ReadCloser, b[:], 1)
+		if n != 0 {
+			return 0, fmt.Errorf("%w: chunk %d decodes to more than expected", ErrChunkSize, c.index)
+		}
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+
+		return 0, err
+	}
+
+	if int64(len(dst)) > c.remaining {
+		dst = dst[:c.remaining]
+	}
+
+	n, err := c.ReadCloser.Read(dst)
+	c.remaining -= int64(n)
+
+	if err == io.EOF && c.remaining > 0 {
+		return n, fmt.Errorf("%w: chunk %d decodes to less than expected", ErrChunkSize, c.index)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+// offsets depend on the block size and file size the caller got from its manifest
+type offsetsKey struct {
+	blockSize uint32
+	size      int64
+}
+
+func (f *File) chunkOffsets(key []byte, src io.ReaderAt, blockSize uint32, size int64) ([]int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	k := offsetsKey{blockSize: blockSize, size: size}
+
+	if offsets, ok := f.offsets[k]; ok {
+		return offsets, nil
+	}
+
+	sizes, ok := f.blockChunkSizes(blockSize, size)
+	if !ok {
+		var err error
+		sizes, err = f.decodedChunkSizes(key, src)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	offsets := make([]int64, len(f.Chunks)+1)
+	for i, s := range sizes {
+		offsets[i+1] = offsets[i] + s
+	}
+
+	if f.offsets == nil {
+		f.offsets = make(map[offsetsKey][]int64)
+	}
+
+	f.offsets[k] = offsets
+
+	return offsets, nil
+}
+
+// compressed chunks decode to a full block each, except for the last one
+func (f *File) blockChunkSizes(blockSize uint32, size int64) ([]int64, bool) {
+	sizes := make([]int64, len(f.Chunks))
+
+	if f.Mode == Raw || f.Mode == Encrypted {
+		for i, c := range f.Chunks {
+			sizes[i] = int64(c.Length)
+		}
+
+		return sizes, true
+	}
+
+	if blockSize == 0 || size < 0 {
+		return nil, false
+	}
+
+	last, count := -1, 0
+	for i, c := range f.Chunks {
+		if c.Length == 0 {
+			continue
+		}
+
+		sizes[i] = int64(blockSize)
+		last = i
+		count++
+	}
+
+	if last == -1 {
+		return sizes, size == 0
+	}
+
+	sizes[last] = size - int64(count-1)*int64(blockSize)
+
+	// doesn't add up, chunks will need decoding
+	if sizes[last] <= 0 || sizes[last] > int64(blockSize) {
+		return nil, false
+	}
+
+	return sizes, true
+}
+
+func (f *File) decodedChunkSizes(key []byte, src io.ReaderAt) ([]int64, error) {
+	sizes := make([]int64, len(f.Chunks))
+
+	for i, c := range f.Chunks {
+		reader, err := c.NewReader(key, src, f.Mode, DefaultBufferSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open chunk %d: %s", i, err)
+		}
+
+		sizes[i], err = io.Copy(io.Discard, reader)
+		reader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode chunk %d: %s", i, err)
+		}
+	}
+
+	return sizes, nil
+}
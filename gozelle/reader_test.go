@@ -0,0 +1,176 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gozelle
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, 16)
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+
+	// half random, half compressible
+	for i := size / 2; i < size; i++ {
+		data[i] = byte(i % 7)
+	}
+
+	return data
+}
+
+// encodes data in blockSize chunks into an in-memory storage
+func testFile(t *testing.T, storage *bytes.Buffer, data []byte, blockSize int, mode Mode) *File {
+	t.Helper()
+
+	file := &File{Mode: mode}
+
+	for off := 0; off < len(data); off += blockSize {
+		chunk, err := EncodeChunk(data[off:min(len(data), off+blockSize)], testKey, mode, 9)
+		if err != nil {
+			t.Fatalf("failed to encode chunk: %s", err)
+		}
+
+		file.Chunks = append(file.Chunks, Chunk{Offset: uint64(storage.Len()), Length: uint64(len(chunk))})
+		storage.Write(chunk)
+	}
+
+	return file
+}
+
+func TestFileReaderRead(t *testing.T) {
+	for _, mode := range []Mode{Raw, Compressed, EncryptedCompressed, Encrypted} {
+		for _, size := range []int{0, 1, 0x100, 0x101, 0x3ff, 0x400} {
+			var storage bytes.Buffer
+
+			data := testData(size)
+			file := testFile(t, &storage, data, 0x100, mode)
+
+			r := file.NewReadSeeker(testKey, bytes.NewReader(storage.Bytes()), 0x100, int64(size))
+
+			out, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%s %#x: failed to read: %s", mode, size, err)
+			}
+
+			if !bytes.Equal(out, data) {
+				t.Fatalf("%s %#x: data mismatch", mode, size)
+			}
+
+			n, err := r.Size()
+			if err != nil || n != int64(size) {
+				t.Fatalf("%s %#x: expected size %d, got %d (%v)", mode, size, size, n, err)
+			}
+		}
+	}
+}
+
+func TestFileReaderReadAt(t *testing.T) {
+	var storage bytes.Buffer
+
+	data := testData(0x350)
+	file := testFile(t, &storage, data, 0x100, Compressed)
+
+	r := file.NewReadSeeker(testKey, bytes.NewReader(storage.Bytes()), 0x100, int64(len(data)))
+
+	// spans chunk boundaries, including the short last chunk
+	for _, tc := range []struct{ off, n int }{{0, 0x350}, {0xf0, 0x20}, {0x1ff, 0x102}, {0x2f0, 0x60}, {0x100, 0x100}, {0x34f, 1}} {
+		buf := make([]byte, tc.n)
+
+		n, err := r.ReadAt(buf, int64(tc.off))
+		if err != nil && !(err == io.EOF && tc.off+tc.n == len(data)) {
+			t.Fatalf("ReadAt(%#x, %#x): %s", tc.off, tc.n, err)
+		}
+
+		if n != tc.n || !bytes.Equal(buf, data[tc.off:tc.off+tc.n]) {
+			t.Fatalf("ReadAt(%#x, %#x): data mismatch", tc.off, tc.n)
+		}
+	}
+
+	// past the end
+	n, err := r.ReadAt(make([]byte, 0x20), 0x340)
+	if n != 0x10 || err != io.EOF {
+		t.Fatalf("expected 0x10 bytes and EOF at the end, got %#x, %v", n, err)
+	}
+
+	_, err = r.Seek(0x1f8, io.SeekStart)
+	if err != nil {
+		t.Fatalf("failed to seek: %s", err)
+	}
+
+	buf := make([]byte, 0x10)
+
+	_, err = io.ReadFull(r, buf)
+	if err != nil || !bytes.Equal(buf, data[0x1f8:0x208]) {
+		t.Fatalf("read after seek mismatch: %v", err)
+	}
+}
+
+func TestFileReaderChunkSize(t *testing.T) {
+	var storage bytes.Buffer
+
+	// the middle chunk decodes to more than a block
+	data := testData(0x300)
+	file := testFile(t, &storage, data[:0x100], 0x100, Compressed)
+	file.Chunks = append(file.Chunks, testFile(t, &storage, data[0x100:0x280], 0x180, Compressed).Chunks...)
+	file.Chunks = append(file.Chunks, testFile(t, &storage, data[0x280:], 0x100, Compressed).Chunks...)
+
+	src := bytes.NewReader(storage.Bytes())
+
+	// adds up as three blocks of 0x100, which isn't what's there
+	_, err := io.ReadAll(file.NewReadSeeker(testKey, src, 0x100, 0x280))
+	if !errors.Is(err, ErrChunkSize) {
+		t.Fatalf("expected a chunk size error, got %v", err)
+	}
+
+	_, err = file.NewReadSeeker(testKey, src, 0x100, 0x280).ReadAt(make([]byte, 0x20), 0x1f0)
+	if !errors.Is(err, ErrChunkSize) {
+		t.Fatalf("expected a chunk size error from ReadAt, got %v", err)
+	}
+
+	// without the file size the chunks are decoded to find their sizes
+	out, err := io.ReadAll(file.NewReadSeeker(testKey, src, 0x100, -1))
+	if err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("failed to read with decoded offsets: %v", err)
+	}
+}
+
+func TestFileReaderOffsetsCache(t *testing.T) {
+	var storage bytes.Buffer
+
+	data := testData(0x280)
+	file := testFile(t, &storage, data, 0x100, Compressed)
+
+	src := bytes.NewReader(storage.Bytes())
+
+	// a caller with the wrong size shouldn't break later ones
+	_, err := io.ReadAll(file.NewReadSeeker(testKey, src, 0x100, 0x250))
+	if err == nil {
+		t.Fatalf("expected an error with the wrong size")
+	}
+
+	out, err := io.ReadAll(file.NewReadSeeker(testKey, src, 0x100, 0x280))
+	if err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("failed to read with the right size: %v", err)
+	}
+}
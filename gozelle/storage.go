@@ -0,0 +1,418 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gozelle
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// writes chunks to a data file and their files to an index
+type StorageWriter struct {
+	index io.Writer
+	data  *bufio.Writer
+
+	// index entries wait here until the data they point at is on disk
+	entries bytes.Buffer
+
+	// where the next chunk goes in the data file
+	offset uint64
+
+	// synced on flush, and cut back to their original sizes on abort
+	dataFile  *os.File
+	indexFile *os.File
+	dataSize  int64
+	indexSize int64
+}
+
+func NewStorageWriter(index io.Writer, data io.Writer, offset uint64) *StorageWriter {
+	return &StorageWriter{
+		index:  index,
+		data:   bufio.NewWriterSize(data, 0x10000),
+		offset: offset,
+	}
+}
+
+func newStorageFileWriter(index *os.File, data *os.File) (*StorageWriter, error) {
+	dataInfo, err := data.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat data file: %s", err)
+	}
+
+	indexInfo, err := index.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat index file: %s", err)
+	}
+
+	w := NewStorageWriter(index, data, uint64(dataInfo.Size()))
+	w.dataFile, w.indexFile = data, index
+	w.dataSize, w.indexSize = dataInfo.Size(), indexInfo.Size()
+
+	return w, nil
+}
+
+// adds to the end of an existing storage, or creates a new one
+func AppendStorage(storagedir string, depot int) (*StorageWriter, error) {
+	_, err := RecoverStorage(storagedir, depot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover storage: %s", err)
+	}
+
+	data, err := os.OpenFile(path.Join(storagedir, fmt.Sprintf("%d.data", depot)), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data file: %s", err)
+	}
+
+	index, err := os.OpenFile(path.Join(storagedir, fmt.Sprintf("%d.index", depot)), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		data.Close()
+		return nil, fmt.Errorf("failed to open index file: %s", err)
+	}
+
+	w, err := newStorageFileWriter(index, data)
+	if err != nil {
+		data.Close()
+		index.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *StorageWriter) WriteChunk(chunk []byte) (Chunk, error) {
+	_, err := w.data.Write(chunk)
+	if err != nil {
+		return Chunk{}, fmt.Errorf("failed to write chunk: %s", err)
+	}
+
+	c := Chunk{Offset: w.offset, Length: uint64(len(chunk))}
+
+	w.offset += uint64(len(chunk))
+
+	return c, nil
+}
+
+// how big the data file is so far
+func (w *StorageWriter) Size() uint64 {
+	return w.offset
+}
+
+// chunks are copied as they are, encrypted ones stay encrypted
+func (w *StorageWriter) CopyFile(id int, file *File, src io.ReaderAt) error {
+	copied := &File{Mode: file.Mode}
+
+	for _, c := range file.Chunks {
+		n, err := w.data.ReadFrom(io.NewSectionReader(src, int64(c.Offset), int64(c.Length)))
+		if err != nil {
+			return fmt.Errorf("failed to copy chunk: %s", err)
+		}
+		if uint64(n) != c.Length {
+			return fmt.Errorf("failed to copy chunk: %s", io.ErrUnexpectedEOF)
+		}
+
+		copied.Chunks = append(copied.Chunks, Chunk{Offset: w.offset, Length: c.Length})
+
+		w.offset += c.Length
+	}
+
+	return w.WriteFile(id, copied)
+}
+
+// the file's chunks have to be written first
+func (w *StorageWriter) WriteFile(id int, file *File) error {
+	err := writeUint64List(&w.entries, uint64(id), uint64(len(file.Chunks))*0x10, uint64(file.Mode))
+	if err != nil {
+		return fmt.Errorf("failed to write index entry: %s", err)
+	}
+
+	for _, c := range file.Chunks {
+		err := writeUint64List(&w.entries, c.Offset, c.Length)
+		if err != nil {
+			return fmt.Errorf("failed to write index entry: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// data goes first and is synced so the index never points past the end of it
+func (w *StorageWriter) Flush() error {
+	err := w.data.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write data: %s", err)
+	}
+
+	if w.dataFile != nil {
+		err = w.dataFile.Sync()
+		if err != nil {
+			return fmt.Errorf("failed to sync data file: %s", err)
+		}
+	}
+
+	_, err = w.entries.WriteTo(w.index)
+	if err != nil {
+		return fmt.Errorf("failed to write index: %s", err)
+	}
+
+	if w.indexFile != nil {
+		err = w.indexFile.Sync()
+		if err != nil {
+			return fmt.Errorf("failed to sync index file: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// writes a whole new storage next to the old one, which is only replaced if fn succeeds
+func RewriteStorage(storagedir string, depot int, fn func(w *StorageWriter) error) error {
+	dataName := path.Join(storagedir, fmt.Sprintf("%d.data", depot))
+	indexName := path.Join(storagedir, fmt.Sprintf("%d.index", depot))
+
+	_, err := RecoverStorage(storagedir, depot)
+	if err != nil {
+		return fmt.Errorf("failed to recover storage: %s", err)
+	}
+
+	// there has to be an old pair to swap out
+	for _, name := range []string{dataName, indexName} {
+		_, err := os.Stat(name)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %s", path.Base(name), err)
+		}
+	}
+
+	data, err := os.OpenFile(dataName+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open data file: %s", err)
+	}
+
+	index, err := os.OpenFile(indexName+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		data.Close()
+		os.Remove(dataName + ".tmp")
+		return fmt.Errorf("failed to open index file: %s", err)
+	}
+
+	w, err := newStorageFileWriter(index, data)
+	if err != nil {
+		data.Close()
+		index.Close()
+		os.Remove(dataName + ".tmp")
+		os.Remove(indexName + ".tmp")
+		return err
+	}
+
+	err = fn(w)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		w.Abort()
+		os.Remove(dataName + ".tmp")
+		os.Remove(indexName + ".tmp")
+		return err
+	}
+
+	// the old pair is kept as .bak until both new files are in place, RecoverStorage
+	// finishes or undoes the swap if it gets interrupted
+	for _, name := range []string{dataName, indexName} {
+		err = os.Rename(name, name+".bak")
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to back up %s: %s", path.Base(name), err), restoreStorage(dataName, indexName))
+		}
+	}
+
+	err = syncDir(storagedir)
+	if err != nil {
+		return errors.Join(err, restoreStorage(dataName, indexName))
+	}
+
+	for _, name := range []string{indexName, dataName} {
+		err = os.Rename(name+".tmp", name)
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to replace %s: %s", path.Base(name), err), restoreStorage(dataName, indexName))
+		}
+	}
+
+	err = syncDir(storagedir)
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(os.Remove(dataName+".bak"), os.Remove(indexName+".bak"))
+}
+
+// cleans up after a RewriteStorage that didn't finish, returning whether there was anything to do
+func RecoverStorage(storagedir string, depot int) (bool, error) {
+	dataName := path.Join(storagedir, fmt.Sprintf("%d.data", depot))
+	indexName := path.Join(storagedir, fmt.Sprintf("%d.index", depot))
+
+	tmp, bak := leftovers(dataName, indexName)
+
+	switch {
+	case bak && tmp:
+		// interrupted mid swap, go back to the old pair
+		return true, restoreStorage(dataName, indexName)
+	case bak:
+		// both new files made it, only the backups are left
+		return true, errors.Join(removeIfExists(dataName+".bak"), removeIfExists(indexName+".bak"))
+	case tmp:
+		// interrupted while writing, the old pair was never touched
+		return true, errors.Join(removeIfExists(dataName+".tmp"), removeIfExists(indexName+".tmp"))
+	}
+
+	return false, nil
+}
+
+// readers leave recovering to the writers, a reader could be racing a rewrite that's still going
+func checkStorage(storagedir string, depot int) error {
+	dataName := path.Join(storagedir, fmt.Sprintf("%d.data", depot))
+	indexName := path.Join(storagedir, fmt.Sprintf("%d.index", depot))
+
+	// new files without backups are a rewrite that hasn't swapped yet, and backups on their own mean the swap finished
+	tmp, bak := leftovers(dataName, indexName)
+	if tmp && bak {
+		return fmt.Errorf("storage for depot %d is halfway through a rewrite, it's recovered the next time the storage is written to", depot)
+	}
+
+	return nil
+}
+
+func leftovers(dataName string, indexName string) (bool, bool) {
+	tmp := exists(dataName+".tmp") || exists(indexName+".tmp")
+	bak := exists(dataName+".bak") || exists(indexName+".bak")
+
+	return tmp, bak
+}
+
+// puts back whatever was moved to .bak and throws away the new files
+func restoreStorage(names ...string) error {
+	var errs []error
+	for _, name := range names {
+		if exists(name + ".bak") {
+			err := os.Rename(name+".bak", name)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to restore %s: %s", path.Base(name), err))
+			}
+		}
+
+		errs = append(errs, removeIfExists(name+".tmp"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func exists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+func removeIfExists(name string) error {
+	err := os.Remove(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// makes renames in dir durable
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open storage directory: %s", err)
+	}
+
+	defer f.Close()
+
+	err = f.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync storage directory: %s", err)
+	}
+
+	return nil
+}
+
+// opens a depot's data file, making sure the index doesn't point past the end of it
+func OpenData(storagedir string, depot int, index Index) (*os.File, error) {
+	data, err := os.Open(path.Join(storagedir, fmt.Sprintf("%d.data", depot)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data file: %s", err)
+	}
+
+	info, err := data.Stat()
+	if err != nil {
+		data.Close()
+		return nil, fmt.Errorf("failed to stat data file: %s", err)
+	}
+
+	end := index.End()
+	if end > uint64(info.Size()) {
+		data.Close()
+		return nil, fmt.Errorf("index for depot %d points past the end of its data file (%d > %d bytes), storage is damaged", depot, end, info.Size())
+	}
+
+	return data, nil
+}
+
+// commits everything written, if that fails the files are cut back like Abort
+func (w *StorageWriter) Close() error {
+	if w.dataFile == nil {
+		return w.Flush()
+	}
+
+	err := w.Flush()
+	if err != nil {
+		return errors.Join(err, w.Abort())
+	}
+
+	err = errors.Join(w.dataFile.Close(), w.indexFile.Close())
+	w.dataFile, w.indexFile = nil, nil
+
+	return err
+}
+
+// throws away everything since the writer was opened, does nothing after Close
+func (w *StorageWriter) Abort() error {
+	w.entries.Reset()
+
+	if w.dataFile == nil {
+		return nil
+	}
+
+	err := errors.Join(
+		w.indexFile.Truncate(w.indexSize),
+		w.dataFile.Truncate(w.dataSize),
+		w.indexFile.Close(),
+		w.dataFile.Close(),
+	)
+	w.dataFile, w.indexFile = nil, nil
+
+	if err != nil {
+		return fmt.Errorf("failed to restore storage: %s", err)
+	}
+
+	return nil
+}
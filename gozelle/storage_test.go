@@ -0,0 +1,342 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gozelle
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// appends one file of chunks to a depot's storage
+func testAppend(t *testing.T, w *StorageWriter, id int, data []byte) {
+	t.Helper()
+
+	chunk, err := EncodeChunk(data, nil, Raw, 0)
+	if err != nil {
+		t.Fatalf("failed to encode chunk: %s", err)
+	}
+
+	c, err := w.WriteChunk(chunk)
+	if err != nil {
+		t.Fatalf("failed to write chunk: %s", err)
+	}
+
+	err = w.WriteFile(id, &File{Chunks: []Chunk{c}, Mode: Raw})
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+}
+
+func TestStorageWriterIndexAfterData(t *testing.T) {
+	var index, data bytes.Buffer
+
+	w := NewStorageWriter(&index, &data, 0)
+	testAppend(t, w, 1, testData(0x100))
+
+	if index.Len() != 0 {
+		t.Fatalf("index written before flush")
+	}
+
+	err := w.Flush()
+	if err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	got, err := indexFromReader(&index)
+	if err != nil {
+		t.Fatalf("failed to read index: %s", err)
+	}
+
+	if len(got) != 1 || got[1].Chunks[0].Offset+got[1].Chunks[0].Length != uint64(data.Len()) {
+		t.Fatalf("index doesn't match data: %v, %d bytes", got, data.Len())
+	}
+}
+
+func TestAppendStorageAbort(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := AppendStorage(dir, 1)
+	if err != nil {
+		t.Fatalf("failed to open storage: %s", err)
+	}
+
+	testAppend(t, w, 1, testData(0x100))
+
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("failed to close storage: %s", err)
+	}
+
+	before := map[string][]byte{}
+	for _, name := range []string{"1.data", "1.index"} {
+		before[name], err = os.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", name, err)
+		}
+	}
+
+	w, err = AppendStorage(dir, 1)
+	if err != nil {
+		t.Fatalf("failed to open storage: %s", err)
+	}
+
+	testAppend(t, w, 2, testData(0x20000))
+
+	// flushed data has to go too, not just what's still buffered
+	err = w.Flush()
+	if err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	testAppend(t, w, 3, testData(0x100))
+
+	err = w.Abort()
+	if err != nil {
+		t.Fatalf("failed to abort: %s", err)
+	}
+
+	for name, want := range before {
+		got, err := os.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", name, err)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s changed after abort: %d bytes, want %d", name, len(got), len(want))
+		}
+	}
+
+	// aborting after close leaves the storage alone
+	w, err = AppendStorage(dir, 1)
+	if err != nil {
+		t.Fatalf("failed to open storage: %s", err)
+	}
+
+	testAppend(t, w, 2, testData(0x100))
+
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("failed to close storage: %s", err)
+	}
+
+	err = w.Abort()
+	if err != nil {
+		t.Fatalf("failed to abort: %s", err)
+	}
+
+	index, err := IndexFromFile(dir, 1)
+	if err != nil {
+		t.Fatalf("failed to read index: %s", err)
+	}
+
+	if len(index) != 2 {
+		t.Fatalf("got %d files, want 2", len(index))
+	}
+}
+
+// writes a depot 1 storage holding one file per entry in sizes
+func testStorage(t *testing.T, dir string, sizes ...int) map[string][]byte {
+	t.Helper()
+
+	w, err := AppendStorage(dir, 1)
+	if err != nil {
+		t.Fatalf("failed to open storage: %s", err)
+	}
+
+	for i, size := range sizes {
+		testAppend(t, w, i+1, testData(size))
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("failed to close storage: %s", err)
+	}
+
+	return testReadStorage(t, dir)
+}
+
+func testReadStorage(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+
+	files := map[string][]byte{}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read storage dir: %s", err)
+	}
+
+	for _, e := range entries {
+		files[e.Name()], err = os.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", e.Name(), err)
+		}
+	}
+
+	return files
+}
+
+func TestRewriteStorage(t *testing.T) {
+	dir := t.TempDir()
+	old := testStorage(t, dir, 0x100, 0x200)
+
+	failed := errors.New("failed")
+
+	err := RewriteStorage(dir, 1, func(w *StorageWriter) error {
+		testAppend(t, w, 1, testData(0x300))
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("got error %v, want %v", err, failed)
+	}
+
+	if got := testReadStorage(t, dir); !maps.EqualFunc(got, old, bytes.Equal) {
+		t.Fatalf("failed rewrite changed the storage: %v", slices.Sorted(maps.Keys(got)))
+	}
+
+	err = RewriteStorage(dir, 1, func(w *StorageWriter) error {
+		testAppend(t, w, 1, testData(0x300))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to rewrite storage: %s", err)
+	}
+
+	got := testReadStorage(t, dir)
+	if len(got) != 2 || len(got["1.data"]) != 0x300 {
+		t.Fatalf("unexpected storage after rewrite: %v, %d bytes of data", slices.Sorted(maps.Keys(got)), len(got["1.data"]))
+	}
+
+	index, err := IndexFromFile(dir, 1)
+	if err != nil {
+		t.Fatalf("failed to read index: %s", err)
+	}
+
+	data, err := OpenData(dir, 1, index)
+	if err != nil {
+		t.Fatalf("failed to open data: %s", err)
+	}
+
+	data.Close()
+}
+
+func TestRecoverStorage(t *testing.T) {
+	// files left behind by each step of an interrupted rewrite, from the new pair (.tmp)
+	// and old pair (.bak), whether readers can still use the storage as it is, and
+	// whether the old pair should come back
+	tests := []struct {
+		name     string
+		steps    []string
+		readable bool
+		old      bool
+	}{
+		{"writing", []string{"data.tmp", "index.tmp"}, true, true},
+		{"one backed up", []string{"data.tmp", "index.tmp", "data.bak"}, false, true},
+		{"both backed up", []string{"data.tmp", "index.tmp", "data.bak", "index.bak"}, false, true},
+		{"index swapped", []string{"data.tmp", "index.tmp", "data.bak", "index.bak", "index"}, false, true},
+		{"both swapped", []string{"data.tmp", "index.tmp", "data.bak", "index.bak", "index", "data"}, true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, newdir := t.TempDir(), t.TempDir()
+
+			old := testStorage(t, dir, 0x100, 0x200)
+			newer := testStorage(t, newdir, 0x300)
+
+			for _, step := range test.steps {
+				name, ext, _ := strings.Cut(step, ".")
+				name = "1." + name
+
+				switch ext {
+				case "tmp":
+					err := os.Rename(path.Join(newdir, name), path.Join(dir, name+".tmp"))
+					if err != nil {
+						t.Fatal(err)
+					}
+				case "bak":
+					err := os.Rename(path.Join(dir, name), path.Join(dir, name+".bak"))
+					if err != nil {
+						t.Fatal(err)
+					}
+				case "":
+					err := os.Rename(path.Join(dir, name+".tmp"), path.Join(dir, name))
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			// readers never touch the files
+			before := testReadStorage(t, dir)
+
+			_, err := IndexFromFile(dir, 1)
+			if (err == nil) != test.readable {
+				t.Fatalf("got error %v reading index, want readable %t", err, test.readable)
+			}
+
+			if got := testReadStorage(t, dir); !maps.EqualFunc(got, before, bytes.Equal) {
+				t.Fatalf("reading the index changed the storage: %v", slices.Sorted(maps.Keys(got)))
+			}
+
+			recovered, err := RecoverStorage(dir, 1)
+			if err != nil || !recovered {
+				t.Fatalf("failed to recover storage: %v", err)
+			}
+
+			want := newer
+			if test.old {
+				want = old
+			}
+
+			if got := testReadStorage(t, dir); !maps.EqualFunc(got, want, bytes.Equal) {
+				t.Fatalf("unexpected storage after recovery: %v", slices.Sorted(maps.Keys(got)))
+			}
+
+			recovered, err = RecoverStorage(dir, 1)
+			if err != nil || recovered {
+				t.Fatalf("storage still needs recovering: %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenDataMismatch(t *testing.T) {
+	dir := t.TempDir()
+	testStorage(t, dir, 0x100, 0x200)
+
+	index, err := IndexFromFile(dir, 1)
+	if err != nil {
+		t.Fatalf("failed to read index: %s", err)
+	}
+
+	err = os.Truncate(path.Join(dir, "1.data"), 0x200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenData(dir, 1, index)
+	if err == nil {
+		t.Fatalf("opened data shorter than its index")
+	}
+}
@@ -0,0 +1,200 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/patapancakes/exdepot/gozelle"
+)
+
+// kept in the output directory until an extraction finishes
+const journalName = ".exdepot-journal"
+
+// one line per finished file with its item number, file id, size and crc32
+type journal struct {
+	mu   sync.Mutex
+	file *os.File
+	name string
+}
+
+// with resume the items the old journal says are finished, and still look it, are returned
+func openJournal(outpath string, manifest gozelle.Manifest, resume bool, include []string, exclude []string) (*journal, map[int]bool, error) {
+	name := path.Join(outpath, journalName)
+
+	// the filters are part of the header so resuming with different ones starts over
+	header := fmt.Sprintf("exdepot journal %d %d include %q exclude %q", manifest.DepotID, manifest.DepotVersion, include, exclude)
+
+	finished := make(map[int]bool)
+
+	if resume {
+		var err error
+		finished, err = readJournal(name, header, outpath, manifest)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	flags := os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	if len(finished) != 0 {
+		flags = os.O_CREATE | os.O_APPEND | os.O_WRONLY
+	}
+
+	file, err := os.OpenFile(name, flags, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open journal: %s", err)
+	}
+
+	if len(finished) == 0 {
+		_, err = fmt.Fprintf(file, "%s\n", header)
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("failed to write journal: %s", err)
+		}
+
+		err = file.Sync()
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("failed to sync journal: %s", err)
+		}
+	}
+
+	return &journal{file: file, name: name}, finished, nil
+}
+
+func readJournal(name string, header string, outpath string, manifest gozelle.Manifest) (map[int]bool, error) {
+	finished := make(map[int]bool)
+
+	file, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return finished, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %s", err)
+	}
+
+	defer file.Close()
+
+	s := bufio.NewScanner(file)
+
+	// journals from other versions are started over
+	if !s.Scan() || s.Text() != header {
+		return finished, nil
+	}
+
+	for s.Scan() {
+		var n int
+		var id uint32
+		var size int64
+		var checksum uint32
+
+		// the last line can be cut short if the process was killed
+		_, err := fmt.Sscanf(s.Text(), "%d %d %d %08x", &n, &id, &size, &checksum)
+		if err != nil {
+			continue
+		}
+
+		if n < 0 || n >= len(manifest.Items) {
+			continue
+		}
+
+		i := manifest.Items[n]
+		if i.IsDirectory() || i.ID != id || int64(i.Size) != size {
+			continue
+		}
+
+		// partial, missing or changed files are redone
+		info, err := os.Stat(path.Join(outpath, i.Path))
+		if err != nil || !info.Mode().IsRegular() || info.Size() != size {
+			continue
+		}
+
+		crc, err := fileCRC(path.Join(outpath, i.Path))
+		if err != nil || crc != checksum {
+			continue
+		}
+
+		finished[n] = true
+	}
+
+	err = s.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %s", err)
+	}
+
+	return finished, nil
+}
+
+func fileCRC(name string) (uint32, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	crc := crc32.NewIEEE()
+
+	_, err = io.Copy(crc, file)
+	if err != nil {
+		return 0, err
+	}
+
+	return crc.Sum32(), nil
+}
+
+// synced every time so a crash can't lose lines for files that were already written
+func (j *journal) record(n int, i gozelle.Item, result ExtractorResult) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	_, err := fmt.Fprintf(j.file, "%d %d %d %08x\n", n, i.ID, result.Size, result.Checksum)
+	if err != nil {
+		return fmt.Errorf("failed to write journal: %s", err)
+	}
+
+	err = j.file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync journal: %s", err)
+	}
+
+	return nil
+}
+
+// the journal isn't needed once everything is extracted
+func (j *journal) finish() error {
+	err := j.file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close journal: %s", err)
+	}
+
+	err = os.Remove(j.name)
+	if err != nil {
+		return fmt.Errorf("failed to remove journal: %s", err)
+	}
+
+	return nil
+}
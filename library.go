@@ -0,0 +1,334 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patapancakes/exdepot/gozelle"
+)
+
+type DepotVersion struct {
+	Depot   int `json:"depot"`
+	Version int `json:"version"`
+}
+
+type Storage struct {
+	Index gozelle.Index
+	Data  *os.File
+}
+
+// lazily loaded and cached manifests and storages for serving
+type Library struct {
+	manifestdir      string
+	storagedir       string
+	manifestchecksum string
+	keys             gozelle.Keys
+
+	mu          sync.Mutex
+	manifests   map[DepotVersion]gozelle.Manifest
+	storages    map[int]*Storage
+	filesystems map[DepotVersion]*gozelle.FS
+}
+
+func NewLibrary(manifestdir string, storagedir string, manifestchecksum string, keys gozelle.Keys) *Library {
+	return &Library{
+		manifestdir:      manifestdir,
+		storagedir:       storagedir,
+		manifestchecksum: manifestchecksum,
+		keys:             keys,
+		manifests:        make(map[DepotVersion]gozelle.Manifest),
+		storages:         make(map[int]*Storage),
+		filesystems:      make(map[DepotVersion]*gozelle.FS),
+	}
+}
+
+// every <depot>_<version>.manifest in the manifest directory
+func (l *Library) Versions() ([]DepotVersion, error) {
+	return findVersions(l.manifestdir)
+}
+
+func findVersions(manifestdir string) ([]DepotVersion, error) {
+	entries, err := os.ReadDir(manifestdir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest directory: %s", err)
+	}
+
+	var versions []DepotVersion
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		name, ok := strings.CutSuffix(e.Name(), ".manifest")
+		if !ok {
+			continue
+		}
+
+		var v DepotVersion
+
+		_, err := fmt.Sscanf(name, "%d_%d", &v.Depot, &v.Version)
+		if err != nil || fmt.Sprintf("%d_%d", v.Depot, v.Version) != name {
+			continue
+		}
+
+		versions = append(versions, v)
+	}
+
+	slices.SortFunc(versions, func(a DepotVersion, b DepotVersion) int {
+		if a.Depot != b.Depot {
+			return a.Depot - b.Depot
+		}
+
+		return a.Version - b.Version
+	})
+
+	return versions, nil
+}
+
+func (l *Library) Manifest(depot int, version int) (gozelle.Manifest, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.manifest(depot, version)
+}
+
+func (l *Library) manifest(depot int, version int) (gozelle.Manifest, error) {
+	dv := DepotVersion{Depot: depot, Version: version}
+
+	manifest, ok := l.manifests[dv]
+	if ok {
+		return manifest, nil
+	}
+
+	manifest, err := loadManifest(l.manifestdir, depot, version, l.manifestchecksum)
+	if err != nil {
+		return manifest, err
+	}
+
+	l.manifests[dv] = manifest
+
+	return manifest, nil
+}
+
+func (l *Library) Storage(depot int) (*Storage, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.storage(depot)
+}
+
+func (l *Library) storage(depot int) (*Storage, error) {
+	storage, ok := l.storages[depot]
+	if ok {
+		return storage, nil
+	}
+
+	index, err := gozelle.IndexFromFile(l.storagedir, depot)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := gozelle.OpenData(l.storagedir, depot, index)
+	if err != nil {
+		return nil, err
+	}
+
+	storage = &Storage{Index: index, Data: data}
+	l.storages[depot] = storage
+
+	return storage, nil
+}
+
+func (l *Library) FS(depot int, version int) (*gozelle.FS, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	dv := DepotVersion{Depot: depot, Version: version}
+
+	fsys, ok := l.filesystems[dv]
+	if ok {
+		return fsys, nil
+	}
+
+	manifest, err := l.manifest(depot, version)
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := l.storage(depot)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys = gozelle.NewFS(manifest, storage.Index, storage.Data, l.keys[depot])
+	l.filesystems[dv] = fsys
+
+	return fsys, nil
+}
+
+func (l *Library) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for depot, s := range l.storages {
+		s.Data.Close()
+		delete(l.storages, depot)
+	}
+
+	clear(l.filesystems)
+
+	return nil
+}
+
+// every depot and version under one tree, <depot>/<version>/<path>
+func (l *Library) Root() fs.FS {
+	return libraryFS{library: l}
+}
+
+type libraryFS struct {
+	library *Library
+}
+
+func (lfs libraryFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	versions, err := lfs.library.Versions()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	// depots
+	if name == "." {
+		var entries []fs.DirEntry
+		for i, v := range versions {
+			if i != 0 && versions[i-1].Depot == v.Depot {
+				continue
+			}
+
+			entries = append(entries, virtualInfo{name: strconv.Itoa(v.Depot)})
+		}
+
+		return &virtualDir{info: virtualInfo{name: "."}, entries: entries}, nil
+	}
+
+	parts := strings.SplitN(name, "/", 3)
+
+	depot, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	// versions of a depot
+	if len(parts) == 1 {
+		var entries []fs.DirEntry
+		for _, v := range versions {
+			if v.Depot == depot {
+				entries = append(entries, virtualInfo{name: strconv.Itoa(v.Version)})
+			}
+		}
+
+		if entries == nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+
+		return &virtualDir{info: virtualInfo{name: parts[0]}, entries: entries}, nil
+	}
+
+	version, err := strconv.Atoi(parts[1])
+	if err != nil || !slices.Contains(versions, DepotVersion{Depot: depot, Version: version}) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	fsys, err := lfs.library.FS(depot, version)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	// depot version root
+	if len(parts) == 2 {
+		entries, err := fsys.ReadDir(".")
+		if err != nil {
+			return nil, err
+		}
+
+		return &virtualDir{info: virtualInfo{name: parts[1]}, entries: entries}, nil
+	}
+
+	return fsys.Open(parts[2])
+}
+
+type virtualInfo struct {
+	name string
+}
+
+func (i virtualInfo) Name() string               { return i.name }
+func (i virtualInfo) Size() int64                { return 0 }
+func (i virtualInfo) Mode() fs.FileMode          { return fs.ModeDir | 0555 }
+func (i virtualInfo) ModTime() time.Time         { return time.Time{} }
+func (i virtualInfo) IsDir() bool                { return true }
+func (i virtualInfo) Sys() any                   { return nil }
+func (i virtualInfo) Type() fs.FileMode          { return fs.ModeDir }
+func (i virtualInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+type virtualDir struct {
+	info    virtualInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *virtualDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *virtualDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *virtualDir) Close() error {
+	return nil
+}
+
+func (d *virtualDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(remaining))
+	d.offset += n
+
+	return remaining[:n], nil
+}
@@ -19,132 +19,556 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path"
 	"runtime"
+	"strings"
 	"sync"
 
 	"github.com/patapancakes/exdepot/gozelle"
 	"github.com/schollz/progressbar/v3"
 )
 
+type command struct {
+	name string
+	desc string
+
+	// adds the command's flags and returns what to run once they're parsed
+	setup func(f *flag.FlagSet) func() error
+}
+
+var commands = []command{
+	{"extract", "extract a depot version to a directory", extractCommand},
+	{"batch", "extract many depot versions at once", batchCommand},
+	{"validate", "check every file in a depot version against the storage", validateCommand},
+	{"ls", "list the paths in a depot version", lsCommand},
+	{"cat", "write one file from a depot version to stdout", catCommand},
+	{"diff", "compare two versions of a depot", diffCommand},
+	{"manifest", "print a manifest as json", manifestCommand},
+	{"index", "print a storage index as json", indexCommand},
+	{"buildmanifest", "turn manifest json back into a binary manifest", buildManifestCommand},
+	{"tar", "write a depot version as a tar archive", tarCommand},
+	{"zip", "write a depot version as a zip archive", zipCommand},
+	{"gcf", "write a depot version as a gcf cache", gcfCommand},
+	{"convert", "fold a gcf or ncf cache into the manifest and storage directories", convertCommand},
+	{"pack", "build a depot version from a directory", packCommand},
+	{"compact", "drop files no manifest uses from a storage", compactCommand},
+	{"rekey", "decrypt a storage or encrypt it with a new key", rekeyCommand},
+	{"repack", "recompress a storage", repackCommand},
+	{"serve", "serve every depot version over http", serveCommand},
+	{"webdav", "serve every depot version over webdav", webdavCommand},
+}
+
 func main() {
-	keyfile := flag.String("keyfile", "depotkeys.json", "path to depot keys file")
-	manifestdir := flag.String("manifestdir", "manifests", "path to manifests directory")
-	storagedir := flag.String("storagedir", "storages", "path to storages directory")
-	outpath := flag.String("outpath", "", "path to output directory or file")
-	depot := flag.Int("depot", 0, "depot id to extract")
-	version := flag.Int("version", 0, "depot version to extract")
-	workers := flag.Int("workers", runtime.NumCPU(), "number of extraction workers")
-	mode := flag.String("mode", "extract", "mode to use (extract, validate, filelist, manifestjson, indexjson)")
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
 
-	flag.Parse()
+	name, args := os.Args[1], os.Args[2:]
 
-	// "interactive" mode
-	if *mode == "extract" || *outpath != "" {
-		fmt.Printf("exdepot by Pancakes (patapancakes@pagefault.games)\n")
-		fmt.Printf("https://github.com/patapancakes/exdepot\n")
-		fmt.Printf("Depot %d Version %d\n", *depot, *version)
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		if len(args) == 0 {
+			usage()
+			return
+		}
+
+		cmd, ok := findCommand(args[0])
+		if !ok {
+			log.Fatalf("unknown command %s", args[0])
+		}
+
+		f, _ := cmd.flagSet()
+		f.Usage()
+
+		return
 	}
 
-	// async related
-	var wg sync.WaitGroup
+	cmd, ok := findCommand(name)
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	f, run := cmd.flagSet()
+
+	err := f.Parse(args)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+
+	if f.NArg() != 0 {
+		log.Fatalf("unexpected arguments: %v", f.Args())
+	}
+
+	err = run()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+
+	return command{}, false
+}
+
+func (c command) flagSet() (*flag.FlagSet, func() error) {
+	f := flag.NewFlagSet(c.name, flag.ContinueOnError)
+
+	f.Usage = func() {
+		fmt.Fprintf(f.Output(), "usage: exdepot %s [flags]\n\n%s\n\nflags:\n", c.name, c.desc)
+		f.PrintDefaults()
+	}
+
+	return f, c.setup(f)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: exdepot <command> [flags]\n\ncommands:\n")
+
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", c.name, c.desc)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nrun \"exdepot help <command>\" for a command's flags\n")
+}
+
+func checkManifestVerification(verification string) error {
+	if verification != "off" && verification != "lenient" && verification != "strict" {
+		return fmt.Errorf("unknown manifest checksum verification %s", verification)
+	}
+
+	return nil
+}
+
+func extractCommand(f *flag.FlagSet) func() error {
+	src := addSourceFlags(f, needKeys|needManifest|needIndex|needData)
+	outpath := f.String("outpath", "", "path to output directory")
+	workers := f.Int("workers", runtime.NumCPU(), "number of extraction workers")
+	memory := f.Int("memory", 0, "memory budget for extraction buffers in MiB (0 for default buffer sizes)")
+	from := f.Int("from", -1, "version already extracted to outpath, only changes since then are written (-1 for a full extraction)")
+	resume := f.Bool("resume", false, "skip files an interrupted extraction to outpath already finished")
 
-	var err error
+	var include, exclude patternList
+	f.Var(&include, "include", "only extract paths matching this glob, can be repeated")
+	f.Var(&exclude, "exclude", "skip paths matching this glob, can be repeated")
 
-	// keys
-	var keys gozelle.Keys
+	return func() error {
+		src.banner()
 
-	wg.Add(1)
-	go func() {
-		keys, err = gozelle.KeysFromFile(*keyfile)
+		s, err := src.load()
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
-		wg.Done()
-	}()
+		defer s.Close()
 
-	// manifest
-	var manifest gozelle.Manifest
+		var previous *gozelle.Manifest
+		if *from >= 0 {
+			if *outpath == "" {
+				return fmt.Errorf("updating from a previous version needs an outpath")
+			}
+
+			// files left out of either extraction would be counted as unchanged or removed without being written
+			if len(include) != 0 || len(exclude) != 0 {
+				return fmt.Errorf("updating from a previous version can't be combined with include or exclude")
+			}
+
+			manifest, err := loadManifest(*src.manifestdir, int(s.manifest.DepotID), *from, *src.manifestchecksum)
+			if err != nil {
+				return err
+			}
+
+			previous = &manifest
+		}
+
+		return doExtract(s.data, *outpath, *workers, *memory, s.keys, s.manifest, s.index, previous, *resume, include, exclude)
+	}
+}
 
-	wg.Add(1)
-	go func() {
-		manifest, err = gozelle.ManifestFromFile(*manifestdir, *depot, *version)
+func batchCommand(f *flag.FlagSet) func() error {
+	jobs := f.String("jobs", "", "path to a json list of jobs (defaults to every manifest in manifestdir)")
+	outpath := f.String("outpath", "{depot}_{version}", "output directory template")
+	workers := f.Int("workers", runtime.NumCPU(), "number of extraction workers")
+	memory := f.Int("memory", 0, "memory budget for extraction buffers in MiB (0 for default buffer sizes)")
+	dedup := f.String("dedup", "off", "link files shared between versions instead of writing them again (off, hardlink, reflink, auto)")
+	keyfile := f.String("keyfile", "depotkeys.json", "path to depot keys file")
+	manifestdir := f.String("manifestdir", "manifests", "path to manifests directory")
+	storagedir := f.String("storagedir", "storages", "path to storages directory")
+	manifestchecksum := f.String("manifestchecksum", "lenient", "manifest checksum verification (off, lenient, strict)")
+
+	return func() error {
+		err := checkManifestVerification(*manifestchecksum)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
-		wg.Done()
-	}()
+		return doBatch(*jobs, *outpath, *workers, *memory, *dedup, *keyfile, *manifestdir, *storagedir, *manifestchecksum)
+	}
+}
+
+func validateCommand(f *flag.FlagSet) func() error {
+	src := addSourceFlags(f, needKeys|needManifest|needIndex|needData|needChecksums)
+	workers := f.Int("workers", runtime.NumCPU(), "number of validation workers")
 
-	// index
-	var index gozelle.Index
+	return func() error {
+		src.banner()
 
-	wg.Add(1)
-	go func() {
-		index, err = gozelle.IndexFromFile(*storagedir, *depot)
+		s, err := src.load()
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
-		wg.Done()
-	}()
+		defer s.Close()
 
-	wg.Wait()
+		return doValidate(s.data, *workers, s.keys, s.manifest, s.index, s.checksums)
+	}
+}
+
+func lsCommand(f *flag.FlagSet) func() error {
+	src := addSourceFlags(f, needManifest)
+	outpath := f.String("outpath", "", "path to output file")
+
+	var include, exclude patternList
+	f.Var(&include, "include", "only list paths matching this glob, can be repeated")
+	f.Var(&exclude, "exclude", "skip paths matching this glob, can be repeated")
+
+	return func() error {
+		s, err := src.load()
+		if err != nil {
+			return err
+		}
+
+		defer s.Close()
 
-	if int(manifest.DepotID) != *depot {
-		log.Fatalf("manifest depot id %d does not match input %d", manifest.DepotID, *depot)
+		return doFileList(s.manifest, *outpath, include, exclude)
 	}
-	if int(manifest.DepotVersion) != *version {
-		log.Fatalf("manifest depot version %d does not match input %d", manifest.DepotVersion, *version)
+}
+
+func diffCommand(f *flag.FlagSet) func() error {
+	src := addSourceFlags(f, needManifest|needChecksums)
+	from := f.Int("from", 0, "old depot version")
+	fromgcf := f.String("fromgcf", "", "path to a gcf or ncf file with the old version to use instead of from")
+	asJSON := f.Bool("json", false, "write the differences as json")
+	outpath := f.String("outpath", "", "path to output file")
+
+	return func() error {
+		s, err := src.load()
+		if err != nil {
+			return err
+		}
+
+		defer s.Close()
+
+		// each side's checksums come from wherever its manifest did, a cache file's
+		// can disagree with the storage's even for the same file id
+		checksums := s.checksums
+		oldChecksums := s.checksums
+
+		var old gozelle.Manifest
+		if *fromgcf != "" {
+			cache, err := gozelle.GCFFromFile(*fromgcf, "")
+			if err != nil {
+				return err
+			}
+
+			defer cache.Close()
+
+			old = cache.Manifest
+			oldChecksums = cache.Checksums
+		} else {
+			old, err = loadManifest(*src.manifestdir, int(s.manifest.DepotID), *from, *src.manifestchecksum)
+			if err != nil {
+				return err
+			}
+
+			if *src.gcf != "" {
+				oldChecksums, err = loadChecksums(*src.storagedir, int(old.DepotID))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if old.DepotID != s.manifest.DepotID {
+			return fmt.Errorf("can't compare depot %d with depot %d", old.DepotID, s.manifest.DepotID)
+		}
+
+		if checksums == nil || oldChecksums == nil {
+			log.Print("couldn't find checksums for both versions, changes are only detected by file id and size")
+		}
+
+		return doDiff(old, s.manifest, oldChecksums, checksums, *outpath, *asJSON)
 	}
+}
 
-	switch *mode {
-	case "extract":
-		err = doExtract(*storagedir, *outpath, *workers, keys, manifest, index)
-	case "validate":
-		err = fmt.Errorf("not implemented yet")
-	case "filelist":
-		err = doFileList(manifest, *outpath)
-	case "manifestjson":
-		err = doManifestJSON(manifest, *outpath)
-	case "indexjson":
-		err = doIndexJSON(index, *outpath)
-	default:
-		err = fmt.Errorf("unknown mode %s", *mode)
+func catCommand(f *flag.FlagSet) func() error {
+	src := addSourceFlags(f, needKeys|needManifest|needIndex|needData)
+	name := f.String("path", "", "path of the file in the depot")
+
+	return func() error {
+		s, err := src.load()
+		if err != nil {
+			return err
+		}
+
+		defer s.Close()
+
+		return doCat(s.data, *name, s.keys, s.manifest, s.index)
 	}
-	if err != nil {
-		log.Fatal(err)
+}
+
+func manifestCommand(f *flag.FlagSet) func() error {
+	src := addSourceFlags(f, needManifest)
+	outpath := f.String("outpath", "", "path to output file")
+
+	return func() error {
+		s, err := src.load()
+		if err != nil {
+			return err
+		}
+
+		defer s.Close()
+
+		return doManifestJSON(s.manifest, *outpath)
 	}
 }
 
-func doExtract(storagedir string, outpath string, workers int, keys gozelle.Keys, manifest gozelle.Manifest, index gozelle.Index) error {
-	fmt.Printf("Using %d extraction workers\n", workers)
+func indexCommand(f *flag.FlagSet) func() error {
+	src := addSourceFlags(f, needIndex)
+	outpath := f.String("outpath", "", "path to output file")
 
-	if outpath == "" {
-		outpath = fmt.Sprintf("%d_%d", manifest.DepotID, manifest.DepotVersion)
+	return func() error {
+		s, err := src.load()
+		if err != nil {
+			return err
+		}
+
+		defer s.Close()
+
+		return doIndexJSON(s.index, *outpath)
 	}
+}
 
-	// extract
-	data, err := os.Open(path.Join(storagedir, fmt.Sprintf("%d.data", manifest.DepotID)))
-	if err != nil {
-		return fmt.Errorf("failed to open data file: %s", err)
+func buildManifestCommand(f *flag.FlagSet) func() error {
+	inpath := f.String("inpath", "", "path to the manifest json (defaults to stdin)")
+	outpath := f.String("outpath", "", "path to output file")
+
+	return func() error {
+		return doManifestFromJSON(*inpath, *outpath)
+	}
+}
+
+func tarCommand(f *flag.FlagSet) func() error {
+	src := addSourceFlags(f, needKeys|needManifest|needIndex|needData)
+	outpath := f.String("outpath", "", "path to output file (defaults to stdout)")
+
+	return func() error {
+		// stdout is the archive
+		if *outpath != "" {
+			src.banner()
+		}
+
+		s, err := src.load()
+		if err != nil {
+			return err
+		}
+
+		defer s.Close()
+
+		return doTar(s.data, *outpath, s.keys, s.manifest, s.index)
+	}
+}
+
+func zipCommand(f *flag.FlagSet) func() error {
+	src := addSourceFlags(f, needKeys|needManifest|needIndex|needData)
+	outpath := f.String("outpath", "", "path to output file")
+	workers := f.Int("workers", runtime.NumCPU(), "number of compression workers")
+	zipmethod := f.String("zipmethod", "deflate", "zip compression method (store, deflate)")
+
+	return func() error {
+		src.banner()
+
+		s, err := src.load()
+		if err != nil {
+			return err
+		}
+
+		defer s.Close()
+
+		return doZip(s.data, *outpath, *workers, *zipmethod, s.keys, s.manifest, s.index)
+	}
+}
+
+func gcfCommand(f *flag.FlagSet) func() error {
+	src := addSourceFlags(f, needKeys|needManifest|needIndex|needData)
+	outpath := f.String("outpath", "", "path to output file")
+	keepencryption := f.Bool("keepencryption", false, "keep encrypted files encrypted")
+
+	return func() error {
+		src.banner()
+
+		s, err := src.load()
+		if err != nil {
+			return err
+		}
+
+		defer s.Close()
+
+		return doGCF(s.data, *outpath, *keepencryption, s.keys, s.manifest, s.index)
+	}
+}
+
+func convertCommand(f *flag.FlagSet) func() error {
+	gcf := f.String("gcf", "", "path to the gcf or ncf file to convert")
+	commondir := f.String("commondir", "", "path to the common folder with the contents of an ncf file")
+	manifestdir := f.String("manifestdir", "manifests", "path to manifests directory")
+	storagedir := f.String("storagedir", "storages", "path to storages directory")
+
+	return func() error {
+		return doConvert(*gcf, *commondir, *manifestdir, *storagedir)
+	}
+}
+
+func packCommand(f *flag.FlagSet) func() error {
+	inpath := f.String("inpath", "", "path to the directory to pack")
+	depot := f.Int("depot", 0, "depot id")
+	version := f.Int("version", 0, "depot version")
+	packmode := f.String("packmode", "compressed", "storage mode for packed files (raw, compressed, encryptedcompressed, encrypted)")
+	blocksize := f.Int("blocksize", 0x8000, "block size for packed files")
+	level := f.Int("level", 9, "zlib compression level")
+	keyfile := f.String("keyfile", "depotkeys.json", "path to depot keys file")
+	manifestdir := f.String("manifestdir", "manifests", "path to manifests directory")
+	storagedir := f.String("storagedir", "storages", "path to storages directory")
+
+	return func() error {
+		return doPack(*inpath, *depot, *version, *packmode, *blocksize, *level, *keyfile, *manifestdir, *storagedir)
+	}
+}
+
+func compactCommand(f *flag.FlagSet) func() error {
+	depot := f.Int("depot", 0, "depot id")
+	dryrun := f.Bool("dryrun", false, "only report what would be reclaimed")
+	manifestdir := f.String("manifestdir", "manifests", "path to manifests directory")
+	storagedir := f.String("storagedir", "storages", "path to storages directory")
+	manifestchecksum := f.String("manifestchecksum", "lenient", "manifest checksum verification (off, lenient, strict)")
+
+	return func() error {
+		err := checkManifestVerification(*manifestchecksum)
+		if err != nil {
+			return err
+		}
+
+		return doCompact(*depot, *dryrun, *manifestdir, *storagedir, *manifestchecksum)
+	}
+}
+
+func rekeyCommand(f *flag.FlagSet) func() error {
+	depot := f.Int("depot", 0, "depot id")
+	decrypt := f.Bool("decrypt", false, "remove encryption instead of encrypting with the new key")
+	keyfile := f.String("keyfile", "depotkeys.json", "path to depot keys file")
+	newkeyfile := f.String("newkeyfile", "", "path to the depot keys file with the new keys (defaults to keyfile)")
+	storagedir := f.String("storagedir", "storages", "path to storages directory")
+
+	return func() error {
+		return doRekey(*depot, *decrypt, *keyfile, *newkeyfile, *storagedir)
+	}
+}
+
+func repackCommand(f *flag.FlagSet) func() error {
+	depot := f.Int("depot", 0, "depot id")
+	level := f.Int("level", 9, "zlib compression level")
+	workers := f.Int("workers", runtime.NumCPU(), "number of compression workers")
+	memory := f.Int("memory", 256, "memory budget for recompressed files waiting to be written in MiB")
+	keyfile := f.String("keyfile", "depotkeys.json", "path to depot keys file")
+	storagedir := f.String("storagedir", "storages", "path to storages directory")
+
+	return func() error {
+		return doRepack(*depot, *level, *workers, *memory, *keyfile, *storagedir)
 	}
+}
+
+func serveCommand(f *flag.FlagSet) func() error {
+	listen := f.String("listen", ":8080", "address to listen on")
+	keyfile := f.String("keyfile", "depotkeys.json", "path to depot keys file")
+	manifestdir := f.String("manifestdir", "manifests", "path to manifests directory")
+	storagedir := f.String("storagedir", "storages", "path to storages directory")
+	manifestchecksum := f.String("manifestchecksum", "lenient", "manifest checksum verification (off, lenient, strict)")
+
+	return func() error {
+		err := checkManifestVerification(*manifestchecksum)
+		if err != nil {
+			return err
+		}
+
+		return doServe(*listen, *keyfile, *manifestdir, *storagedir, *manifestchecksum)
+	}
+}
+
+func webdavCommand(f *flag.FlagSet) func() error {
+	listen := f.String("listen", ":8080", "address to listen on")
+	keyfile := f.String("keyfile", "depotkeys.json", "path to depot keys file")
+	manifestdir := f.String("manifestdir", "manifests", "path to manifests directory")
+	storagedir := f.String("storagedir", "storages", "path to storages directory")
+	manifestchecksum := f.String("manifestchecksum", "lenient", "manifest checksum verification (off, lenient, strict)")
 
-	defer data.Close()
+	return func() error {
+		err := checkManifestVerification(*manifestchecksum)
+		if err != nil {
+			return err
+		}
+
+		return doWebDAV(*listen, *keyfile, *manifestdir, *storagedir, *manifestchecksum)
+	}
+}
+
+// previous is the manifest of the version already in outpath, only what changed since then is written
+func doExtract(data io.ReaderAt, outpath string, workers int, memory int, keys gozelle.Keys, manifest gozelle.Manifest, index gozelle.Index, previous *gozelle.Manifest, resume bool, include []string, exclude []string) error {
+	workers, size := extractorBuffers(memory, workers)
+
+	fmt.Printf("Using %d extraction workers with %d KiB buffers\n", workers, size/1024)
+
+	if outpath == "" {
+		outpath = fmt.Sprintf("%d_%d", manifest.DepotID, manifest.DepotVersion)
+	}
 
 	key, ok := keys[int(manifest.DepotID)]
 	if !ok {
 		log.Print("couldn't find key for depot")
 	}
 
+	var unchanged map[string]bool
+	if previous != nil {
+		var removed int
+		var err error
+
+		unchanged, removed, err = removeStale(outpath, *previous, manifest)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Updating from version %d, %d files unchanged, %d removed or replaced\n", previous.DepotVersion, len(unchanged), removed)
+	}
+
+	selected := selectItems(manifest, include, exclude)
+
 	// create directories
-	for _, i := range manifest.Items {
-		if !i.IsDirectory() {
+	for n, i := range manifest.Items {
+		if !i.IsDirectory() || !selected[n] {
 			continue
 		}
 
@@ -154,28 +578,53 @@ func doExtract(storagedir string, outpath string, workers int, keys gozelle.Keys
 		}
 	}
 
+	journal, finished, err := openJournal(outpath, manifest, resume, include, exclude)
+	if err != nil {
+		return err
+	}
+
+	if resume {
+		fmt.Printf("Resuming, %d files already extracted\n", len(finished))
+	}
+
 	jobs := make(chan ExtractorJob)
 
 	var wg sync.WaitGroup
 
 	for range workers {
 		wg.Add(1)
-		go extractorWorker(&wg, jobs, data, key)
+		go extractorWorker(&wg, jobs, size)
+	}
+
+	done := func(n int, i gozelle.Item) func(ExtractorResult) {
+		return func(result ExtractorResult) {
+			if result.Err != nil {
+				log.Fatal(result.Err)
+			}
+
+			err := journal.record(n, i, result)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
 
 	bar := progressbar.Default(int64(len(manifest.Items)), "Extracting")
 
 	// create files
-	for _, i := range manifest.Items {
+	for n, i := range manifest.Items {
 		bar.Add(1)
 
-		if i.IsDirectory() {
+		if i.IsDirectory() || !selected[n] || unchanged[i.Path] || finished[n] {
 			continue
 		}
 
 		jobs <- ExtractorJob{
 			Path: path.Join(outpath, i.Path),
 			File: index[int(i.ID)],
+			Data: data,
+			Key:  key,
+			Done: done(n, i),
 		}
 	}
 
@@ -183,21 +632,196 @@ func doExtract(storagedir string, outpath string, workers int, keys gozelle.Keys
 
 	wg.Wait()
 
+	return journal.finish()
+}
+
+// lenient verification only logs checksum mismatches
+func loadManifest(manifestdir string, depot int, version int, verification string) (gozelle.Manifest, error) {
+	manifest, err := gozelle.ManifestFromFile(manifestdir, depot, version, verification != "off")
+	if errors.Is(err, gozelle.ErrManifestChecksum) && verification == "lenient" {
+		log.Printf("depot %d version %d: %s", depot, version, err)
+		return manifest, nil
+	}
+
+	return manifest, err
+}
+
+// only commands that write to a storage clean up after a rewrite that didn't finish
+func recoverStorage(storagedir string, depot int) error {
+	recovered, err := gozelle.RecoverStorage(storagedir, depot)
+	if err != nil {
+		return fmt.Errorf("failed to recover storage: %s", err)
+	}
+
+	if recovered {
+		log.Printf("cleaned up after an interrupted rewrite of depot %d storage", depot)
+	}
+
 	return nil
 }
 
-func doFileList(manifest gozelle.Manifest, outpath string) error {
-	w := os.Stdout
-	if outpath != "" {
-		var err error
-		w, err = os.OpenFile(outpath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+// checksums are optional, not every storage has them, callers decide what to do without them
+func loadChecksums(storagedir string, depot int) (gozelle.Checksums, error) {
+	_, err := os.Stat(path.Join(storagedir, fmt.Sprintf("%d.checksums", depot)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	return gozelle.ChecksumsFromFile(storagedir, depot)
+}
+
+// adds a depot version to the manifest and storage directories, fill appends its files to
+// the storage and records their checksums, then returns the version's manifest
+func appendVersion(depot int, version int, manifestdir string, storagedir string, fill func(w *gozelle.StorageWriter, index gozelle.Index, checksums gozelle.Checksums) (gozelle.Manifest, error)) error {
+	_, err := os.Stat(path.Join(manifestdir, fmt.Sprintf("%d_%d.manifest", depot, version)))
+	if err == nil {
+		return fmt.Errorf("manifest for depot %d version %d already exists", depot, version)
+	}
+
+	err = recoverStorage(storagedir, depot)
+	if err != nil {
+		return err
+	}
+
+	// existing storage, if there is one
+	index := make(gozelle.Index)
+
+	_, err = os.Stat(path.Join(storagedir, fmt.Sprintf("%d.index", depot)))
+	if err == nil {
+		index, err = gozelle.IndexFromFile(storagedir, depot)
 		if err != nil {
-			return fmt.Errorf("failed to open output file: %s", err)
+			return err
 		}
 	}
 
-	for _, i := range manifest.Items {
-		if i.Path == "" {
+	checksums, err := loadChecksums(storagedir, depot)
+	if err != nil {
+		return err
+	}
+
+	if checksums == nil {
+		checksums = make(gozelle.Checksums)
+	}
+
+	err = os.MkdirAll(storagedir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create storage directory: %s", err)
+	}
+
+	storage, err := gozelle.AppendStorage(storagedir, depot)
+	if err != nil {
+		return err
+	}
+
+	defer storage.Abort()
+
+	manifest, err := fill(storage, index, checksums)
+	if err != nil {
+		return err
+	}
+
+	err = storage.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write storage: %s", err)
+	}
+
+	err = gozelle.ChecksumsToFile(storagedir, depot, checksums)
+	if err != nil {
+		return err
+	}
+
+	// last so a failure doesn't leave a manifest pointing at missing files
+	err = os.MkdirAll(manifestdir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest directory: %s", err)
+	}
+
+	return gozelle.ManifestToFile(manifestdir, manifest)
+}
+
+func doValidate(data io.ReaderAt, workers int, keys gozelle.Keys, manifest gozelle.Manifest, index gozelle.Index, checksums gozelle.Checksums) error {
+	fmt.Printf("Using %d validation workers\n", workers)
+
+	key, ok := keys[int(manifest.DepotID)]
+	if !ok {
+		log.Print("couldn't find key for depot")
+	}
+
+	if checksums == nil {
+		log.Print("couldn't find checksums for depot, only checking sizes")
+	}
+
+	jobs := make(chan ValidatorJob)
+	results := make([]error, len(manifest.Items))
+
+	var wg sync.WaitGroup
+
+	for range workers {
+		wg.Add(1)
+		go validatorWorker(&wg, jobs, results, data, key, checksums, manifest.BlockSize)
+	}
+
+	bar := progressbar.Default(int64(len(manifest.Items)), "Validating")
+
+	for n, i := range manifest.Items {
+		bar.Add(1)
+
+		if i.IsDirectory() {
+			continue
+		}
+
+		jobs <- ValidatorJob{
+			Item: n,
+			ID:   int(i.ID),
+			Size: int64(i.Size),
+			File: index[int(i.ID)],
+		}
+	}
+
+	close(jobs)
+
+	wg.Wait()
+
+	// report
+	var passed, failed int
+	for n, i := range manifest.Items {
+		if i.IsDirectory() {
+			continue
+		}
+
+		if results[n] != nil {
+			fmt.Printf("FAIL %s: %s\n", i.Path, results[n])
+			failed++
+
+			continue
+		}
+
+		fmt.Printf("PASS %s\n", i.Path)
+		passed++
+	}
+
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+
+	if failed != 0 {
+		return fmt.Errorf("%d files failed validation", failed)
+	}
+
+	return nil
+}
+
+func doFileList(manifest gozelle.Manifest, outpath string, include []string, exclude []string) error {
+	w, err := createOutput(outpath)
+	if err != nil {
+		return err
+	}
+
+	return closeOutput(w, writeFileList(w, manifest, selectItems(manifest, include, exclude)))
+}
+
+// selected can be nil to list everything
+func writeFileList(w io.Writer, manifest gozelle.Manifest, selected []bool) error {
+	for n, i := range manifest.Items {
+		if i.Path == "" || (selected != nil && !selected[n]) {
 			continue
 		}
 
@@ -210,16 +834,71 @@ func doFileList(manifest gozelle.Manifest, outpath string) error {
 	return nil
 }
 
-func doManifestJSON(manifest gozelle.Manifest, outpath string) error {
-	w := os.Stdout
-	if outpath != "" {
-		var err error
-		w, err = os.OpenFile(outpath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
-		if err != nil {
-			return fmt.Errorf("failed to open output file: %s", err)
+func doCat(data io.ReaderAt, name string, keys gozelle.Keys, manifest gozelle.Manifest, index gozelle.Index) error {
+	if name == "" {
+		return fmt.Errorf("no path given")
+	}
+
+	item, ok := findItem(manifest, name)
+	if !ok {
+		return fmt.Errorf("couldn't find %s in depot", name)
+	}
+
+	if item.IsDirectory() {
+		return fmt.Errorf("%s is a directory", item.Path)
+	}
+
+	file, ok := index[int(item.ID)]
+	if !ok {
+		return fmt.Errorf("file %s missing from index", item.Path)
+	}
+
+	key, ok := keys[int(manifest.DepotID)]
+	if !ok {
+		log.Print("couldn't find key for depot")
+	}
+
+	r := file.NewReader(key, data, gozelle.DefaultBufferSize)
+	defer r.Close()
+
+	_, err := io.Copy(os.Stdout, r)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %s", err)
+	}
+
+	return nil
+}
+
+// steam paths aren't case sensitive, an exact match wins
+func findItem(manifest gozelle.Manifest, name string) (gozelle.Item, bool) {
+	name = strings.TrimPrefix(path.Clean(strings.ReplaceAll(name, "\\", "/")), "/")
+
+	var found gozelle.Item
+	var ok bool
+
+	for _, i := range manifest.Items {
+		if i.Path == name {
+			return i, true
 		}
+
+		if !ok && strings.EqualFold(i.Path, name) {
+			found, ok = i, true
+		}
+	}
+
+	return found, ok
+}
+
+func doManifestJSON(manifest gozelle.Manifest, outpath string) error {
+	w, err := createOutput(outpath)
+	if err != nil {
+		return err
 	}
 
+	return closeOutput(w, writeManifestJSON(w, manifest))
+}
+
+func writeManifestJSON(w io.Writer, manifest gozelle.Manifest) error {
 	err := json.NewEncoder(w).Encode(manifest)
 	if err != nil {
 		return fmt.Errorf("failed to encode output json: %s", err)
@@ -228,20 +907,93 @@ func doManifestJSON(manifest gozelle.Manifest, outpath string) error {
 	return nil
 }
 
-func doIndexJSON(index gozelle.Index, outpath string) error {
-	w := os.Stdout
-	if outpath != "" {
+// turns manifestjson output back into a binary manifest
+func doManifestFromJSON(inpath string, outpath string) error {
+	r := os.Stdin
+	if inpath != "" {
 		var err error
-		w, err = os.OpenFile(outpath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+		r, err = os.Open(inpath)
 		if err != nil {
-			return fmt.Errorf("failed to open output file: %s", err)
+			return fmt.Errorf("failed to open input file: %s", err)
 		}
+
+		defer r.Close()
+	}
+
+	var manifest gozelle.Manifest
+
+	err := json.NewDecoder(r).Decode(&manifest)
+	if err != nil {
+		return fmt.Errorf("failed to decode input json: %s", err)
 	}
 
-	err := json.NewEncoder(w).Encode(index)
+	data, err := manifest.MarshalBinary()
 	if err != nil {
-		return fmt.Errorf("failed to encode output json: %s", err)
+		return fmt.Errorf("failed to encode manifest: %s", err)
+	}
+
+	w, err := createOutput(outpath)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		err = fmt.Errorf("failed to write to output file: %s", err)
+	}
+
+	return closeOutput(w, err)
+}
+
+// stdout unless a path is given
+func createOutput(outpath string) (*os.File, error) {
+	if outpath == "" {
+		return os.Stdout, nil
+	}
+
+	w, err := os.OpenFile(outpath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open output file: %s", err)
+	}
+
+	return w, nil
+}
+
+// the only close of an output file, it's synced first if writing it went fine, stdout is left alone
+func closeOutput(w *os.File, err error) error {
+	if w == os.Stdout {
+		return err
+	}
+
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	err = w.Sync()
+	if err != nil {
+		w.Close()
+		return fmt.Errorf("failed to sync output file: %s", err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close output file: %s", err)
 	}
 
 	return nil
 }
+
+func doIndexJSON(index gozelle.Index, outpath string) error {
+	w, err := createOutput(outpath)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(index)
+	if err != nil {
+		err = fmt.Errorf("failed to encode output json: %s", err)
+	}
+
+	return closeOutput(w, err)
+}
@@ -0,0 +1,86 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"iter"
+	"sync"
+)
+
+type orderedJob[J any, R any] struct {
+	Job    J
+	Result chan R
+}
+
+// runs work on every job across the workers and hands the results to write in job order,
+// done is called for each job once its result has been written or thrown away
+func runOrdered[J any, R any](workers int, jobs iter.Seq[J], work func(J) R, write func(J, R) error, done func(J)) error {
+	queue := make(chan orderedJob[J, R])
+
+	// jobs in the order they came in, bounded so finished ones don't pile up in memory
+	pending := make(chan orderedJob[J, R], workers*2)
+
+	var wg sync.WaitGroup
+
+	for range workers {
+		wg.Add(1)
+		go orderedWorker(&wg, queue, work)
+	}
+
+	go func() {
+		for job := range jobs {
+			o := orderedJob[J, R]{Job: job, Result: make(chan R, 1)}
+
+			pending <- o
+			queue <- o
+		}
+
+		close(queue)
+		close(pending)
+	}()
+
+	// pending has to be drained even after a failure so the workers can exit
+	var err error
+	for o := range pending {
+		result := <-o.Result
+		if err == nil {
+			err = write(o.Job, result)
+		}
+
+		if done != nil {
+			done(o.Job)
+		}
+	}
+
+	wg.Wait()
+
+	return err
+}
+
+func orderedWorker[J any, R any](wg *sync.WaitGroup, queue chan orderedJob[J, R], work func(J) R) {
+	defer wg.Done()
+
+	for {
+		o, ok := <-queue
+		if !ok {
+			break
+		}
+
+		o.Result <- work(o.Job)
+	}
+}
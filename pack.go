@@ -0,0 +1,90 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/patapancakes/exdepot/gozelle"
+)
+
+// builds a new depot version from a directory, appending to the depot's storage
+func doPack(inpath string, depot int, version int, packmode string, blocksize int, level int, keyfile string, manifestdir string, storagedir string) error {
+	if inpath == "" {
+		return fmt.Errorf("no input directory given")
+	}
+
+	mode, err := gozelle.ParseMode(packmode)
+	if err != nil {
+		return err
+	}
+
+	opts := gozelle.PackOptions{
+		DepotID:      uint32(depot),
+		DepotVersion: uint32(version),
+		BlockSize:    uint32(blocksize),
+		Mode:         mode,
+		Level:        level,
+	}
+
+	if mode == gozelle.EncryptedCompressed || mode == gozelle.Encrypted {
+		keys, err := gozelle.KeysFromFile(keyfile)
+		if err != nil {
+			return err
+		}
+
+		key, ok := keys[depot]
+		if !ok {
+			return fmt.Errorf("couldn't find key for depot %d", depot)
+		}
+
+		opts.Key = key
+	}
+
+	fmt.Printf("Packing %s as depot %d version %d\n", inpath, depot, version)
+
+	var manifest gozelle.Manifest
+
+	err = appendVersion(depot, version, manifestdir, storagedir, func(w *gozelle.StorageWriter, index gozelle.Index, checksums gozelle.Checksums) (gozelle.Manifest, error) {
+		// new files go after everything already in the storage
+		for id := range index {
+			opts.FirstID = max(opts.FirstID, id+1)
+		}
+
+		m, packed, err := gozelle.Pack(os.DirFS(inpath), w, opts)
+		if err != nil {
+			return m, err
+		}
+
+		for id, list := range packed {
+			checksums[id] = list
+		}
+
+		manifest = m
+
+		return m, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Packed %d files into %d items\n", manifest.NumFiles, manifest.NumItems)
+
+	return nil
+}
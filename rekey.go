@@ -0,0 +1,180 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+
+	"github.com/patapancakes/exdepot/gozelle"
+	"github.com/schollz/progressbar/v3"
+)
+
+// encrypted files either lose their encryption or everything gets encrypted with the key from newkeyfile
+func doRekey(depot int, decrypt bool, keyfile string, newkeyfile string, storagedir string) error {
+	keys, err := gozelle.KeysFromFile(keyfile)
+	if err != nil {
+		return err
+	}
+
+	// plain storages don't need a key to start with
+	key := keys[depot]
+
+	var newKey []byte
+	if !decrypt {
+		if newkeyfile != "" {
+			keys, err = gozelle.KeysFromFile(newkeyfile)
+			if err != nil {
+				return err
+			}
+		}
+
+		var ok bool
+		newKey, ok = keys[depot]
+		if !ok {
+			return fmt.Errorf("couldn't find new key for depot %d", depot)
+		}
+	}
+
+	err = recoverStorage(storagedir, depot)
+	if err != nil {
+		return err
+	}
+
+	index, err := gozelle.IndexFromFile(storagedir, depot)
+	if err != nil {
+		return err
+	}
+
+	data, err := gozelle.OpenData(storagedir, depot, index)
+	if err != nil {
+		return err
+	}
+
+	defer data.Close()
+
+	// the only way to tell if the old key is right for files that are encrypted but not compressed
+	checksums, err := loadChecksums(storagedir, depot)
+	if err != nil {
+		return err
+	}
+
+	if checksums == nil {
+		log.Print("couldn't find checksums for depot, encrypted files can't be checked against the old key")
+	}
+
+	bar := progressbar.Default(int64(len(index)), "Rewriting")
+
+	var changed int
+
+	err = gozelle.RewriteStorage(storagedir, depot, func(w *gozelle.StorageWriter) error {
+		for _, id := range slices.Sorted(maps.Keys(index)) {
+			bar.Add(1)
+
+			file := index[id]
+			mode := rekeyMode(file.Mode, decrypt)
+
+			// decrypting leaves plain files alone
+			if decrypt && mode == file.Mode {
+				err := w.CopyFile(id, file, data)
+				if err != nil {
+					return fmt.Errorf("failed to copy file %d: %s", id, err)
+				}
+
+				continue
+			}
+
+			rekeyed := &gozelle.File{Mode: mode}
+			for n, c := range file.Chunks {
+				chunk := make([]byte, c.Length)
+
+				_, err := io.ReadFull(io.NewSectionReader(data, int64(c.Offset), int64(c.Length)), chunk)
+				if err != nil {
+					return fmt.Errorf("failed to read file %d: %s", id, err)
+				}
+
+				original, err := decodeChunk(gozelle.Chunk{Length: c.Length}, key, bytes.NewReader(chunk), file.Mode)
+				if err != nil {
+					return fmt.Errorf("failed to decode file %d, the old key may be wrong: %s", id, err)
+				}
+
+				list := checksums[id]
+				if n < len(list) && gozelle.Checksum(original) != list[n] {
+					return fmt.Errorf("file %d doesn't match its checksums, the old key may be wrong", id)
+				}
+
+				chunk, err = gozelle.RekeyChunk(chunk, key, file.Mode, newKey, mode)
+				if err != nil {
+					return fmt.Errorf("failed to rekey file %d: %s", id, err)
+				}
+
+				// make sure nothing was lost before the old storage is replaced
+				check, err := decodeChunk(gozelle.Chunk{Length: uint64(len(chunk))}, newKey, bytes.NewReader(chunk), mode)
+				if err != nil {
+					return fmt.Errorf("failed to decode rekeyed file %d: %s", id, err)
+				}
+
+				if !bytes.Equal(check, original) {
+					return fmt.Errorf("rekeyed file %d doesn't match the original", id)
+				}
+
+				written, err := w.WriteChunk(chunk)
+				if err != nil {
+					return err
+				}
+
+				rekeyed.Chunks = append(rekeyed.Chunks, written)
+			}
+
+			err := w.WriteFile(id, rekeyed)
+			if err != nil {
+				return err
+			}
+
+			changed++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Rewrote %d of %d files\n", changed, len(index))
+
+	return nil
+}
+
+func rekeyMode(mode gozelle.Mode, decrypt bool) gozelle.Mode {
+	switch {
+	case decrypt && mode == gozelle.EncryptedCompressed:
+		return gozelle.Compressed
+	case decrypt && mode == gozelle.Encrypted:
+		return gozelle.Raw
+	case !decrypt && mode == gozelle.Compressed:
+		return gozelle.EncryptedCompressed
+	case !decrypt && mode == gozelle.Raw:
+		return gozelle.Encrypted
+	}
+
+	return mode
+}
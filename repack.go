@@ -0,0 +1,275 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/patapancakes/exdepot/gozelle"
+	"github.com/schollz/progressbar/v3"
+)
+
+type RepackJob struct {
+	ID   int
+	File *gozelle.File
+
+	// taken from the memory budget until the file is written
+	Reserved int64
+}
+
+type RepackResult struct {
+	Mode   gozelle.Mode
+	Chunks [][]byte
+	Copy   bool
+	Err    error
+}
+
+// caps how many bytes of recompressed files can be waiting to be written
+type repackBudget struct {
+	cond *sync.Cond
+	size int64
+	free int64
+}
+
+func newRepackBudget(size int64) *repackBudget {
+	return &repackBudget{cond: sync.NewCond(&sync.Mutex{}), size: size, free: size}
+}
+
+// files bigger than the whole budget wait until nothing else is held
+func (b *repackBudget) acquire(n int64) int64 {
+	n = min(n, b.size)
+
+	b.cond.L.Lock()
+	for b.free < n {
+		b.cond.Wait()
+	}
+
+	b.free -= n
+	b.cond.L.Unlock()
+
+	return n
+}
+
+func (b *repackBudget) release(n int64) {
+	b.cond.L.Lock()
+	b.free += n
+	b.cond.L.Unlock()
+
+	b.cond.Broadcast()
+}
+
+// recompresses every file that gets smaller at the given level, raw files become compressed
+func doRepack(depot int, level int, workers int, memory int, keyfile string, storagedir string) error {
+	fmt.Printf("Using %d compression workers\n", workers)
+
+	keys, err := gozelle.KeysFromFile(keyfile)
+	if err != nil {
+		return err
+	}
+
+	key, ok := keys[depot]
+	if !ok {
+		log.Print("couldn't find key for depot")
+	}
+
+	err = recoverStorage(storagedir, depot)
+	if err != nil {
+		return err
+	}
+
+	index, err := gozelle.IndexFromFile(storagedir, depot)
+	if err != nil {
+		return err
+	}
+
+	data, err := gozelle.OpenData(storagedir, depot, index)
+	if err != nil {
+		return err
+	}
+
+	defer data.Close()
+
+	info, err := data.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat data file: %s", err)
+	}
+
+	budget := newRepackBudget(max(int64(memory), 1) * 1024 * 1024)
+
+	// the budget is taken before a job is queued, so a full budget holds back new jobs
+	jobs := func(yield func(RepackJob) bool) {
+		for _, id := range slices.Sorted(maps.Keys(index)) {
+			job := RepackJob{ID: id, File: index[id]}
+
+			// a repacked file is never kept once it's as big as the original
+			var size int64
+			for _, c := range job.File.Chunks {
+				size += int64(c.Length)
+			}
+
+			job.Reserved = budget.acquire(size)
+
+			if !yield(job) {
+				return
+			}
+		}
+	}
+
+	bar := progressbar.Default(int64(len(index)), "Repacking")
+
+	var repacked int
+	var size uint64
+
+	err = gozelle.RewriteStorage(storagedir, depot, func(w *gozelle.StorageWriter) error {
+		err := runOrdered(workers, jobs, func(job RepackJob) RepackResult {
+			return repackFile(job, data, key, level)
+		}, func(job RepackJob, result RepackResult) error {
+			err := writeRepacked(w, job, result, data)
+			if err != nil {
+				return err
+			}
+
+			if !result.Copy {
+				repacked++
+			}
+
+			return nil
+		}, func(job RepackJob) {
+			budget.release(job.Reserved)
+			bar.Add(1)
+		})
+		if err != nil {
+			return err
+		}
+
+		size = w.Size()
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Recompressed %d of %d files, data went from %d to %d bytes\n", repacked, len(index), info.Size(), size)
+
+	return nil
+}
+
+func writeRepacked(w *gozelle.StorageWriter, job RepackJob, result RepackResult, data io.ReaderAt) error {
+	if result.Err != nil {
+		return fmt.Errorf("failed to repack file %d: %s", job.ID, result.Err)
+	}
+
+	if result.Copy {
+		err := w.CopyFile(job.ID, job.File, data)
+		if err != nil {
+			return fmt.Errorf("failed to copy file %d: %s", job.ID, err)
+		}
+
+		return nil
+	}
+
+	file := &gozelle.File{Mode: result.Mode}
+	for _, chunk := range result.Chunks {
+		c, err := w.WriteChunk(chunk)
+		if err != nil {
+			return err
+		}
+
+		file.Chunks = append(file.Chunks, c)
+	}
+
+	return w.WriteFile(job.ID, file)
+}
+
+func repackFile(job RepackJob, data io.ReaderAt, key []byte, level int) RepackResult {
+	mode := job.File.Mode
+	switch mode {
+	case gozelle.Raw:
+		mode = gozelle.Compressed
+	case gozelle.Encrypted:
+		// encrypted files can't be compressed without changing their mode
+		return RepackResult{Copy: true}
+	}
+
+	var chunks [][]byte
+	var oldSize, newSize uint64
+
+	for _, c := range job.File.Chunks {
+		oldSize += c.Length
+	}
+
+	for _, c := range job.File.Chunks {
+		decoded, err := decodeChunk(c, key, data, job.File.Mode)
+		if err != nil {
+			return RepackResult{Err: err}
+		}
+
+		encoded, err := gozelle.EncodeChunk(decoded, key, mode, level)
+		if err != nil {
+			return RepackResult{Err: err}
+		}
+
+		// make sure nothing was lost
+		check, err := decodeChunk(gozelle.Chunk{Length: uint64(len(encoded))}, key, bytes.NewReader(encoded), mode)
+		if err != nil {
+			return RepackResult{Err: err}
+		}
+
+		if !bytes.Equal(check, decoded) {
+			return RepackResult{Err: fmt.Errorf("recompressed chunk doesn't match the original")}
+		}
+
+		chunks = append(chunks, encoded)
+
+		// only worth it if the file gets smaller, so give up as soon as it can't
+		newSize += uint64(len(encoded))
+		if newSize >= oldSize {
+			return RepackResult{Copy: true}
+		}
+	}
+
+	// empty files
+	if newSize >= oldSize {
+		return RepackResult{Copy: true}
+	}
+
+	return RepackResult{Mode: mode, Chunks: chunks}
+}
+
+func decodeChunk(c gozelle.Chunk, key []byte, src io.ReaderAt, mode gozelle.Mode) ([]byte, error) {
+	r, err := c.NewReader(key, src, mode, gozelle.DefaultBufferSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode chunk: %s", err)
+	}
+
+	defer r.Close()
+
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode chunk: %s", err)
+	}
+
+	return decoded, nil
+}
@@ -0,0 +1,282 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/patapancakes/exdepot/gozelle"
+)
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<pre>
+{{- if .Parent}}
+<a href="{{.Parent}}">../</a>
+{{- end}}
+{{- range .Entries}}
+<a href="{{.Link}}">{{.Name}}</a>{{if .Size}}  {{.Size}}{{end}}
+{{- end}}
+</pre>
+</body>
+</html>
+`))
+
+type listing struct {
+	Title   string
+	Parent  string
+	Entries []listingEntry
+}
+
+type listingEntry struct {
+	Name string
+	Link string
+	Size string
+}
+
+func doServe(listen string, keyfile string, manifestdir string, storagedir string, manifestchecksum string) error {
+	keys, err := gozelle.KeysFromFile(keyfile)
+	if err != nil {
+		return err
+	}
+
+	library := NewLibrary(manifestdir, storagedir, manifestchecksum, keys)
+	defer library.Close()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		versions, err := library.Versions()
+		if err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		l := listing{Title: "Depots"}
+		for _, v := range versions {
+			l.Entries = append(l.Entries, listingEntry{
+				Name: fmt.Sprintf("%d_%d/", v.Depot, v.Version),
+				Link: fmt.Sprintf("/depot/%d/%d/", v.Depot, v.Version),
+			})
+		}
+
+		writeListing(w, l)
+	})
+
+	mux.HandleFunc("GET /depot/{depot}/{version}/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		fsys, dv, ok := serveFS(w, r, library)
+		if !ok {
+			return
+		}
+
+		name := strings.TrimSuffix(r.PathValue("path"), "/")
+		if name == "" {
+			name = "."
+		}
+
+		info, err := fsys.Stat(name)
+		if err != nil {
+			httpError(w, err, http.StatusNotFound)
+			return
+		}
+
+		if info.IsDir() {
+			if name != "." && r.URL.Path[len(r.URL.Path)-1] != '/' {
+				http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+				return
+			}
+
+			entries, err := fsys.ReadDir(name)
+			if err != nil {
+				httpError(w, err, http.StatusInternalServerError)
+				return
+			}
+
+			l := listing{Title: fmt.Sprintf("Depot %d Version %d: /%s", dv.Depot, dv.Version, r.PathValue("path")), Parent: "../"}
+			for _, e := range entries {
+				entry := listingEntry{Name: e.Name(), Link: (&url.URL{Path: e.Name()}).String()}
+
+				if e.IsDir() {
+					entry.Name += "/"
+					entry.Link += "/"
+				} else {
+					info, err := e.Info()
+					if err == nil {
+						entry.Size = strconv.FormatInt(info.Size(), 10)
+					}
+				}
+
+				l.Entries = append(l.Entries, entry)
+			}
+
+			// nothing above the depot root besides the version list
+			if name == "." {
+				l.Parent = "/"
+			}
+
+			writeListing(w, l)
+
+			return
+		}
+
+		file, err := fsys.Open(name)
+		if err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		defer file.Close()
+
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(name)))
+
+		// handles range requests
+		http.ServeContent(w, r, path.Base(name), time.Time{}, file.(io.ReadSeeker))
+	})
+
+	mux.HandleFunc("GET /depot/{depot}/{version}", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+	})
+
+	mux.HandleFunc("GET /api/versions", func(w http.ResponseWriter, r *http.Request) {
+		versions, err := library.Versions()
+		if err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err = json.NewEncoder(w).Encode(versions)
+		if err != nil {
+			log.Printf("failed to write response: %s", err)
+		}
+	})
+
+	mux.HandleFunc("GET /api/{depot}/{version}/filelist", func(w http.ResponseWriter, r *http.Request) {
+		manifest, ok := serveManifest(w, r, library)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		err := writeFileList(w, manifest, nil)
+		if err != nil {
+			log.Printf("failed to write response: %s", err)
+		}
+	})
+
+	mux.HandleFunc("GET /api/{depot}/{version}/manifest", func(w http.ResponseWriter, r *http.Request) {
+		manifest, ok := serveManifest(w, r, library)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := writeManifestJSON(w, manifest)
+		if err != nil {
+			log.Printf("failed to write response: %s", err)
+		}
+	})
+
+	log.Printf("Serving %s on %s", manifestdir, listen)
+
+	return http.ListenAndServe(listen, mux)
+}
+
+func parseDepotVersion(r *http.Request) (DepotVersion, error) {
+	depot, err := strconv.Atoi(r.PathValue("depot"))
+	if err != nil {
+		return DepotVersion{}, fmt.Errorf("invalid depot id: %s", err)
+	}
+
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		return DepotVersion{}, fmt.Errorf("invalid depot version: %s", err)
+	}
+
+	return DepotVersion{Depot: depot, Version: version}, nil
+}
+
+func serveManifest(w http.ResponseWriter, r *http.Request, library *Library) (gozelle.Manifest, bool) {
+	dv, err := parseDepotVersion(r)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return gozelle.Manifest{}, false
+	}
+
+	manifest, err := library.Manifest(dv.Depot, dv.Version)
+	if err != nil {
+		httpError(w, err, http.StatusNotFound)
+		return gozelle.Manifest{}, false
+	}
+
+	return manifest, true
+}
+
+func serveFS(w http.ResponseWriter, r *http.Request, library *Library) (*gozelle.FS, DepotVersion, bool) {
+	dv, err := parseDepotVersion(r)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return nil, dv, false
+	}
+
+	fsys, err := library.FS(dv.Depot, dv.Version)
+	if err != nil {
+		httpError(w, err, http.StatusNotFound)
+		return nil, dv, false
+	}
+
+	return fsys, dv, true
+}
+
+func writeListing(w http.ResponseWriter, l listing) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	err := listingTemplate.Execute(w, l)
+	if err != nil {
+		log.Printf("failed to write listing: %s", err)
+	}
+}
+
+func httpError(w http.ResponseWriter, err error, status int) {
+	if errors.Is(err, fs.ErrNotExist) {
+		status = http.StatusNotFound
+	}
+
+	http.Error(w, err.Error(), status)
+}
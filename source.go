@@ -0,0 +1,216 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/patapancakes/exdepot/gozelle"
+)
+
+// what a command needs loaded before it can run
+const (
+	needKeys = 1 << iota
+	needManifest
+	needIndex
+	needData
+	needChecksums
+)
+
+// flags for commands that work on a single depot version, only the ones the command needs are added
+type sourceFlags struct {
+	need int
+
+	keyfile          *string
+	manifestdir      *string
+	storagedir       *string
+	manifestchecksum *string
+	gcf              *string
+	commondir        *string
+	depot            *int
+	version          *int
+}
+
+type source struct {
+	keys      gozelle.Keys
+	manifest  gozelle.Manifest
+	index     gozelle.Index
+	checksums gozelle.Checksums
+	data      io.ReaderAt
+
+	closers []io.Closer
+}
+
+func addSourceFlags(f *flag.FlagSet, need int) sourceFlags {
+	s := sourceFlags{need: need}
+
+	if need&needKeys != 0 {
+		s.keyfile = f.String("keyfile", "depotkeys.json", "path to depot keys file")
+	}
+
+	if need&needManifest != 0 {
+		s.manifestdir = f.String("manifestdir", "manifests", "path to manifests directory")
+		s.manifestchecksum = f.String("manifestchecksum", "lenient", "manifest checksum verification (off, lenient, strict)")
+		s.version = f.Int("version", 0, "depot version")
+	}
+
+	if need&(needIndex|needData|needChecksums) != 0 {
+		s.storagedir = f.String("storagedir", "storages", "path to storages directory")
+	}
+
+	s.depot = f.Int("depot", 0, "depot id")
+	s.gcf = f.String("gcf", "", "path to a gcf or ncf file to use instead of a manifest and storage")
+	s.commondir = f.String("commondir", "", "path to the common folder with the contents of an ncf file")
+
+	return s
+}
+
+func (s sourceFlags) load() (*source, error) {
+	src := &source{}
+
+	if s.manifestchecksum != nil {
+		err := checkManifestVerification(*s.manifestchecksum)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// async related
+	var wg sync.WaitGroup
+
+	var keysErr, manifestErr, indexErr error
+
+	// keys
+	if s.need&needKeys != 0 {
+		wg.Add(1)
+		go func() {
+			src.keys, keysErr = gozelle.KeysFromFile(*s.keyfile)
+
+			wg.Done()
+		}()
+	}
+
+	if *s.gcf != "" {
+		// cache files have everything in one place
+		cache, err := gozelle.GCFFromFile(*s.gcf, *s.commondir)
+		if err != nil {
+			wg.Wait()
+			return nil, err
+		}
+
+		src.manifest = cache.Manifest
+		src.index = cache.Index
+		src.checksums = cache.Checksums
+		src.data = cache.Data
+		src.closers = append(src.closers, cache)
+
+		wg.Wait()
+
+		if keysErr != nil {
+			src.Close()
+			return nil, keysErr
+		}
+
+		return src, nil
+	}
+
+	// manifest
+	if s.need&needManifest != 0 {
+		wg.Add(1)
+		go func() {
+			src.manifest, manifestErr = loadManifest(*s.manifestdir, *s.depot, *s.version, *s.manifestchecksum)
+
+			wg.Done()
+		}()
+	}
+
+	// index
+	if s.need&needIndex != 0 {
+		wg.Add(1)
+		go func() {
+			src.index, indexErr = gozelle.IndexFromFile(*s.storagedir, *s.depot)
+
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+
+	err := errors.Join(keysErr, manifestErr, indexErr)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.need&needManifest != 0 {
+		if int(src.manifest.DepotID) != *s.depot {
+			return nil, fmt.Errorf("manifest depot id %d does not match input %d", src.manifest.DepotID, *s.depot)
+		}
+		if int(src.manifest.DepotVersion) != *s.version {
+			return nil, fmt.Errorf("manifest depot version %d does not match input %d", src.manifest.DepotVersion, *s.version)
+		}
+	}
+
+	if s.need&needData != 0 {
+		file, err := gozelle.OpenData(*s.storagedir, *s.depot, src.index)
+		if err != nil {
+			return nil, err
+		}
+
+		src.data = file
+		src.closers = append(src.closers, file)
+	}
+
+	if s.need&needChecksums != 0 {
+		src.checksums, err = loadChecksums(*s.storagedir, *s.depot)
+		if err != nil {
+			src.Close()
+			return nil, err
+		}
+	}
+
+	return src, nil
+}
+
+func (s *source) Close() error {
+	var errs []error
+	for _, c := range s.closers {
+		errs = append(errs, c.Close())
+	}
+
+	s.closers = nil
+
+	return errors.Join(errs...)
+}
+
+// shown by commands that run for a while
+func (s sourceFlags) banner() {
+	fmt.Printf("exdepot by Pancakes (patapancakes@pagefault.games)\n")
+	fmt.Printf("https://github.com/patapancakes/exdepot\n")
+
+	if *s.gcf != "" {
+		fmt.Printf("Cache %s\n", *s.gcf)
+	} else if s.version != nil {
+		fmt.Printf("Depot %d Version %d\n", *s.depot, *s.version)
+	} else {
+		fmt.Printf("Depot %d\n", *s.depot)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/patapancakes/exdepot/gozelle"
+)
+
+type ValidatorJob struct {
+	Item int
+	ID   int
+	Size int64
+	File *gozelle.File
+}
+
+func validatorWorker(wg *sync.WaitGroup, jobs chan ValidatorJob, results []error, data io.ReaderAt, key []byte, checksums gozelle.Checksums, blockSize uint32) {
+	defer wg.Done()
+
+	for {
+		job, ok := <-jobs
+		if !ok {
+			break
+		}
+
+		results[job.Item] = validateFile(job, data, key, checksums, blockSize)
+	}
+}
+
+func validateFile(job ValidatorJob, data io.ReaderAt, key []byte, checksums gozelle.Checksums, blockSize uint32) error {
+	if job.File == nil {
+		return fmt.Errorf("file missing from index")
+	}
+
+	// items can share a file id, so each job gets its own reader
+	f := job.File.NewReader(key, data, gozelle.DefaultBufferSize)
+	defer f.Close()
+
+	var n byteCounter
+
+	r := io.TeeReader(f, &n)
+
+	var err error
+	if checksums != nil {
+		err = checksums.Verify(job.ID, r, blockSize)
+		if err != nil {
+			return fmt.Errorf("failed to verify file: %s", err)
+		}
+	}
+
+	_, err = io.Copy(io.Discard, r)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %s", err)
+	}
+
+	if int64(n) != job.Size {
+		return fmt.Errorf("size mismatch, expected %d bytes, got %d", job.Size, n)
+	}
+
+	return nil
+}
+
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+
+	return len(p), nil
+}
@@ -0,0 +1,240 @@
+/*
+	Copyright (C) 2024  Pancakes <patapancakes@pagefault.games>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/patapancakes/exdepot/gozelle"
+)
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+func doWebDAV(listen string, keyfile string, manifestdir string, storagedir string, manifestchecksum string) error {
+	keys, err := gozelle.KeysFromFile(keyfile)
+	if err != nil {
+		return err
+	}
+
+	library := NewLibrary(manifestdir, storagedir, manifestchecksum, keys)
+	defer library.Close()
+
+	log.Printf("Serving %s over WebDAV on %s", manifestdir, listen)
+
+	return http.ListenAndServe(listen, davHandler{fsys: library.Root()})
+}
+
+// read-only, so no locking or property updates
+type davHandler struct {
+	fsys fs.FS
+}
+
+func (h davHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+		w.Header().Set("MS-Author-Via", "DAV")
+	case http.MethodGet, http.MethodHead:
+		h.serveFile(w, r, name)
+	case "PROPFIND":
+		h.propfind(w, r, name)
+	default:
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+		http.Error(w, "read-only", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h davHandler) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	file, err := h.fsys.Open(name)
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// plain listing for anything that isn't a webdav client
+	if info.IsDir() {
+		entries, err := fs.ReadDir(h.fsys, name)
+		if err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		for _, e := range entries {
+			suffix := ""
+			if e.IsDir() {
+				suffix = "/"
+			}
+
+			fmt.Fprintf(w, "%s%s\n", e.Name(), suffix)
+		}
+
+		return
+	}
+
+	rs, ok := file.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, "file is not seekable", http.StatusInternalServerError)
+		return
+	}
+
+	// handles range requests
+	http.ServeContent(w, r, info.Name(), info.ModTime(), rs)
+}
+
+func (h davHandler) propfind(w http.ResponseWriter, r *http.Request, name string) {
+	// the request body only selects properties, everything is always returned
+	io.Copy(io.Discard, r.Body)
+
+	info, err := fs.Stat(h.fsys, name)
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	href := davHref(name, info.IsDir())
+
+	ms := davMultistatus{Namespace: "DAV:"}
+	ms.Responses = append(ms.Responses, davEntry(href, info))
+
+	// infinite depth isn't supported, treat it like 1
+	if info.IsDir() && r.Header.Get("Depth") != "0" {
+		entries, err := fs.ReadDir(h.fsys, name)
+		if err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				httpError(w, err, http.StatusInternalServerError)
+				return
+			}
+
+			ms.Responses = append(ms.Responses, davEntry(href+davHref(e.Name(), e.IsDir())[1:], info))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+
+	_, err = io.WriteString(w, xml.Header)
+	if err != nil {
+		log.Printf("failed to write response: %s", err)
+		return
+	}
+
+	err = xml.NewEncoder(w).Encode(ms)
+	if err != nil {
+		log.Printf("failed to write response: %s", err)
+	}
+}
+
+func davHref(name string, dir bool) string {
+	if name == "." {
+		return "/"
+	}
+
+	href := (&url.URL{Path: "/" + name}).EscapedPath()
+	if dir {
+		href += "/"
+	}
+
+	return href
+}
+
+func davEntry(href string, info fs.FileInfo) davResponse {
+	modtime := info.ModTime()
+	if modtime.IsZero() {
+		modtime = time.Unix(0, 0)
+	}
+
+	prop := davProp{
+		DisplayName:  info.Name(),
+		LastModified: modtime.UTC().Format(http.TimeFormat),
+	}
+
+	if info.IsDir() {
+		prop.ResourceType.Collection = &struct{}{}
+	} else {
+		size := info.Size()
+		prop.ContentLength = &size
+
+		prop.ContentType = mime.TypeByExtension(path.Ext(info.Name()))
+		if prop.ContentType == "" {
+			prop.ContentType = "application/octet-stream"
+		}
+	}
+
+	return davResponse{
+		Href:     href,
+		Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"},
+	}
+}